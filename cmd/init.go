@@ -0,0 +1,331 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// configFile is the name of the config file written by init.
+const configFile = "goemon.yaml"
+
+// NewCmdInit initializes the init command, which writes goemon.yaml for the project.
+func NewCmdInit() *cobra.Command {
+	var force bool
+	cmd := &cobra.Command{
+		Use:   "init [dir]",
+		Short: "Write goemon.yaml with tasks detected from the project",
+		Long: `Write goemon.yaml with tasks detected from the project in dir, or the current directory.
+
+Commands of cmd/*/main.go or main.go are run with go run, the build script of
+package.json is run on changes of assets, and the Makefile targets run, dev,
+serve or start are used if there are no others.`,
+		Args: cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := "."
+			if len(args) > 0 {
+				dir = args[0]
+			}
+			file := filepath.Join(dir, configFile)
+			if _, err := os.Stat(file); err == nil && !force {
+				return fmt.Errorf("%v already exists, use --force to overwrite", file)
+			}
+			p := detectProject(dir)
+			if err := ioutil.WriteFile(file, []byte(p.config()), 0644); err != nil {
+				return err
+			}
+			fmt.Printf("Wrote %v with tasks %v\n", file, p.taskNames())
+			return nil
+		},
+	}
+	cmd.Flags().BoolVarP(&force, "force", "f", false, "Overwrite the existing goemon.yaml")
+	return cmd
+}
+
+// initTask is a task of the generated config.
+type initTask struct {
+	name      string
+	comment   string
+	commands  []string
+	watches   []string
+	ext       []string
+	basenames []string
+}
+
+// project is what init found in the directory.
+type project struct {
+	module      string
+	tasks       []initTask
+	ignores     []string
+	makeTargets []string
+}
+
+// buildOutputs are directories of build outputs, ignored if they exist.
+var buildOutputs = []string{"bin", "build", "dist", "out", "tmp", "coverage"}
+
+// assetExt are the extensions of the sources of package.json build scripts.
+var assetExt = []string{"js", "jsx", "ts", "tsx", "css", "scss", "html", "vue", "svelte"}
+
+// detectProject inspects the files of dir.
+func detectProject(dir string) *project {
+	p := &project{}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir, name))
+		return err == nil
+	}
+
+	if exists("go.mod") {
+		p.module = goModule(filepath.Join(dir, "go.mod"))
+		p.ignores = append(p.ignores, "vendor")
+	}
+	mains, _ := filepath.Glob(filepath.Join(dir, "cmd", "*", "main.go"))
+	sort.Strings(mains)
+	for _, m := range mains {
+		name := filepath.Base(filepath.Dir(m))
+		p.tasks = append(p.tasks, goTask(p.taskName(name), "./cmd/"+name, "cmd/"+name+"/main.go"))
+	}
+	if len(mains) == 0 && exists("main.go") {
+		name := filepath.Base(p.module)
+		if p.module == "" {
+			abs, _ := filepath.Abs(dir)
+			name = filepath.Base(abs)
+		}
+		p.tasks = append(p.tasks, goTask(p.taskName(name), ".", "main.go"))
+	}
+
+	if exists("package.json") {
+		p.ignores = append(p.ignores, "node_modules")
+		if t, ok := assetTask(dir); ok {
+			t.name = p.taskName(t.name)
+			p.tasks = append(p.tasks, t)
+		}
+	}
+
+	if exists("Makefile") {
+		p.makeTargets = makeTargets(filepath.Join(dir, "Makefile"))
+		if len(p.tasks) == 0 {
+			for _, target := range []string{"run", "dev", "serve", "start"} {
+				if containsString(p.makeTargets, target) {
+					p.tasks = append(p.tasks, initTask{
+						name:     "app",
+						comment:  "make " + target + " of Makefile",
+						commands: []string{"make " + target},
+						watches:  []string{"."},
+					})
+					break
+				}
+			}
+		}
+	}
+
+	for _, v := range buildOutputs {
+		if exists(v) {
+			p.ignores = append(p.ignores, v)
+		}
+	}
+	if len(p.tasks) == 0 {
+		p.tasks = append(p.tasks, initTask{
+			name:     "app",
+			comment:  "Nothing detected, replace with the commands to run",
+			commands: []string{"echo hello"},
+			watches:  []string{"."},
+		})
+	}
+	return p
+}
+
+var unsafeNameRe = regexp.MustCompile(`[^a-z0-9_-]+`)
+
+// subcommands are the names of the subcommands of goemon, which are run
+// instead of the tasks of the same names.
+var subcommands = []string{"init", "help"}
+
+// taskName returns name made safe as a task name, which is a key of the config
+// and an argument of goemon. It is lowercased, other characters than letters,
+// digits, "_" and "-" are replaced with "-", and it is made unique among the
+// tasks and the subcommands.
+func (p *project) taskName(name string) string {
+	name = strings.Trim(unsafeNameRe.ReplaceAllString(strings.ToLower(name), "-"), "-")
+	if name == "" {
+		name = "app"
+	}
+	unique := name
+	for i := 2; containsString(p.taskNames(), unique) || containsString(subcommands, unique); i++ {
+		unique = name + "-" + strconv.Itoa(i)
+	}
+	return unique
+}
+
+// goTask returns the task running the main package pkg by go run.
+func goTask(name, pkg, main string) initTask {
+	return initTask{
+		name:      name,
+		comment:   "go run of " + main,
+		commands:  []string{"go run " + pkg},
+		watches:   []string{"."},
+		ext:       []string{"go"},
+		basenames: []string{"go.mod", "go.sum"},
+	}
+}
+
+// assetTask returns the task running the build script of package.json in dir.
+func assetTask(dir string) (initTask, bool) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return initTask{}, false
+	}
+	var pkg struct {
+		Scripts map[string]string `json:"scripts"`
+	}
+	if err := json.Unmarshal(b, &pkg); err != nil {
+		return initTask{}, false
+	}
+	if _, ok := pkg.Scripts["build"]; !ok {
+		return initTask{}, false
+	}
+
+	run := "npm run build"
+	if _, err := os.Stat(filepath.Join(dir, "yarn.lock")); err == nil {
+		run = "yarn build"
+	} else if _, err := os.Stat(filepath.Join(dir, "pnpm-lock.yaml")); err == nil {
+		run = "pnpm run build"
+	}
+	watches := make([]string, 0)
+	for _, v := range []string{"src", "web", "assets", "public"} {
+		if _, err := os.Stat(filepath.Join(dir, v)); err == nil {
+			watches = append(watches, v)
+		}
+	}
+	if len(watches) == 0 {
+		watches = append(watches, ".")
+	}
+	return initTask{
+		name:     "assets",
+		comment:  "build script of package.json",
+		commands: []string{run},
+		watches:  watches,
+		ext:      assetExt,
+	}, true
+}
+
+// goModule returns the module path of go.mod.
+func goModule(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) >= 2 && fields[0] == "module" {
+			return strings.Trim(fields[1], `"`)
+		}
+	}
+	return ""
+}
+
+var makeTargetRe = regexp.MustCompile(`^([A-Za-z0-9][A-Za-z0-9_.-]*)\s*:([^=]|$)`)
+
+// makeTargets returns the explicit targets of Makefile.
+func makeTargets(file string) []string {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	targets := make([]string, 0)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		m := makeTargetRe.FindStringSubmatch(s.Text())
+		if m != nil && !containsString(targets, m[1]) {
+			targets = append(targets, m[1])
+		}
+	}
+	return targets
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// taskNames returns the names of the tasks.
+func (p *project) taskNames() []string {
+	names := make([]string, 0, len(p.tasks))
+	for _, t := range p.tasks {
+		names = append(names, t.name)
+	}
+	return names
+}
+
+// config returns the commented config of the project.
+func (p *project) config() string {
+	var b strings.Builder
+	w := func(format string, args ...interface{}) {
+		fmt.Fprintf(&b, format+"\n", args...)
+	}
+	list := func(indent, key string, values []string) {
+		if len(values) == 0 {
+			return
+		}
+		w("%s%s:", indent, key)
+		for _, v := range values {
+			w("%s  - %s", indent, strconv.Quote(v))
+		}
+	}
+
+	w("# goemon.yaml generated by \"goemon init\".")
+	w("# Run all the tasks by \"goemon\", or some of them by name like \"goemon %s\".", p.tasks[0].name)
+	w("# Changes of this file are applied while goemon is running.")
+	w("")
+	w("# Quiet period in milliseconds to wait after the last change before restarting.")
+	w("delay: 500")
+	w("")
+	w("# Paths not watched by any task. Prefix with ! to watch them again.")
+	w("# .git is always ignored, and .goemonignore files are loaded from every directory.")
+	if len(p.ignores) == 0 {
+		w("ignore: []")
+	} else {
+		list("", "ignore", p.ignores)
+	}
+	w("# Set true to ignore the files ignored by .gitignore files too.")
+	w("gitignore: false")
+	w("")
+	w("# Tasks are restarted by changes of the files matching their watch, ext and")
+	w("# basename. Each task can also set delay, ignore, ops, env, dir, rules and more.")
+	w("tasks:")
+	for i, t := range p.tasks {
+		if i > 0 {
+			w("")
+		}
+		w("  # %s", t.comment)
+		w("  %s:", t.name)
+		list("    ", "commands", t.commands)
+		list("    ", "watch", t.watches)
+		list("    ", "ext", t.ext)
+		list("    ", "basename", t.basenames)
+		if i == 0 && len(p.makeTargets) > 0 {
+			target := p.makeTargets[0]
+			if containsString(p.makeTargets, "generate") {
+				target = "generate"
+			}
+			w("    # Makefile targets: %s. Run them before restarting by rules like", strings.Join(p.makeTargets, ", "))
+			w("    # rules: [\"*.proto -> run 'make %s' then restart %s\"]", target, t.name)
+		}
+	}
+	return b.String()
+}
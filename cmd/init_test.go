@@ -0,0 +1,284 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+// writeFiles writes files of the contents under dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "goemon_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestDetectProject(t *testing.T) {
+	tests := []struct {
+		name        string
+		files       map[string]string
+		tasks       []string
+		commands    []string
+		ignores     []string
+		makeTargets []string
+	}{
+		{
+			"cmd mains",
+			map[string]string{"go.mod": "module example.com/x", "cmd/api/main.go": "", "cmd/Worker.v2/main.go": ""},
+			[]string{"worker-v2", "api"}, []string{"go run ./cmd/Worker.v2", "go run ./cmd/api"}, []string{"vendor"}, nil,
+		},
+		{
+			"main of module",
+			map[string]string{"go.mod": "module example.com/my.app", "main.go": ""},
+			[]string{"my-app"}, []string{"go run ."}, []string{"vendor"}, nil,
+		},
+		{
+			"assets",
+			map[string]string{"package.json": `{"scripts": {"build": "webpack"}}`, "yarn.lock": "", "src/index.js": "", "dist/app.js": ""},
+			[]string{"assets"}, []string{"yarn build"}, []string{"node_modules", "dist"}, nil,
+		},
+		{
+			"assets without build script",
+			map[string]string{"package.json": `{"scripts": {"test": "jest"}}`},
+			[]string{"app"}, []string{"echo hello"}, []string{"node_modules"}, nil,
+		},
+		{
+			"go and assets task of the same name",
+			map[string]string{"cmd/assets/main.go": "", "package.json": `{"scripts": {"build": "webpack"}}`},
+			[]string{"assets", "assets-2"}, []string{"go run ./cmd/assets", "npm run build"}, []string{"node_modules"}, nil,
+		},
+		{
+			"Makefile",
+			map[string]string{"Makefile": "build:\n\tgo build\ndev: build\n\t./app\n"},
+			[]string{"app"}, []string{"make dev"}, nil, []string{"build", "dev"},
+		},
+		{
+			"Makefile with go",
+			map[string]string{"main.go": "", "Makefile": "generate:\n\tgo generate\n"},
+			[]string{"x"}, []string{"go run ."}, nil, []string{"generate"},
+		},
+		{
+			"nothing",
+			map[string]string{"README.md": ""},
+			[]string{"app"}, []string{"echo hello"}, nil, nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := tempDir(t)
+			defer os.RemoveAll(root)
+			// The name of the main package without go.mod is the one of the directory.
+			dir := filepath.Join(root, "x")
+			writeFiles(t, dir, tt.files)
+
+			p := detectProject(dir)
+			commands := make([]string, 0)
+			for _, task := range p.tasks {
+				commands = append(commands, task.commands...)
+			}
+			if got := p.taskNames(); !reflect.DeepEqual(got, tt.tasks) {
+				t.Errorf("detectProject() tasks = %v, want %v", got, tt.tasks)
+			}
+			if !reflect.DeepEqual(commands, tt.commands) {
+				t.Errorf("detectProject() commands = %v, want %v", commands, tt.commands)
+			}
+			if !reflect.DeepEqual(p.ignores, tt.ignores) {
+				t.Errorf("detectProject() ignores = %v, want %v", p.ignores, tt.ignores)
+			}
+			if len(p.makeTargets) > 0 || len(tt.makeTargets) > 0 {
+				if !reflect.DeepEqual(p.makeTargets, tt.makeTargets) {
+					t.Errorf("detectProject() make targets = %v, want %v", p.makeTargets, tt.makeTargets)
+				}
+			}
+		})
+	}
+}
+
+func TestProject_TaskName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"api", "api"},
+		{"API", "api"},
+		{"my.app", "my-app"},
+		{"my app!", "my-app"},
+		{"web_ui", "web_ui"},
+		{".hidden", "hidden"},
+		{"...", "app"},
+		{"existing", "existing-2"},
+		{"init", "init-2"},
+		{"Help", "help-2"},
+	}
+	p := &project{tasks: []initTask{{name: "existing"}}}
+	for _, tt := range tests {
+		if got := p.taskName(tt.name); got != tt.want {
+			t.Errorf("taskName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSubcommands(t *testing.T) {
+	cmd := NewCmdRoot()
+	for _, c := range cmd.Commands() {
+		if !containsString(subcommands, c.Name()) {
+			t.Errorf("subcommand %q is not reserved", c.Name())
+		}
+	}
+}
+
+func TestMakeTargets(t *testing.T) {
+	tests := []struct {
+		name     string
+		makefile string
+		want     []string
+	}{
+		{"targets", "build:\n\tgo build\nrun: build\n\t./app\n", []string{"build", "run"}},
+		{"duplicated", "run:\n\t./a\nrun:\n\t./b\n", []string{"run"}},
+		{"special targets", ".PHONY: run\nrun:\n\t./app\n", []string{"run"}},
+		{"variables", "GO := go\nOUT = bin\nFLAGS ?= -v\nbuild:\n\t$(GO) build\n", []string{"build"}},
+		{"recipes", "build:\n\techo a: b\n", []string{"build"}},
+		{"no targets", "# empty\n", []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			writeFiles(t, dir, map[string]string{"Makefile": tt.makefile})
+
+			if got := makeTargets(filepath.Join(dir, "Makefile")); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("makeTargets() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if got := makeTargets("missing/Makefile"); got != nil {
+		t.Errorf("makeTargets() of missing file = %v, want nil", got)
+	}
+}
+
+func TestGoModule(t *testing.T) {
+	tests := []struct {
+		name  string
+		gomod string
+		want  string
+	}{
+		{"module", "module example.com/x\n\ngo 1.12\n", "example.com/x"},
+		{"quoted", "module \"example.com/x\"\n", "example.com/x"},
+		{"comment", "// Deprecated: use y\nmodule example.com/x // legacy\n", "example.com/x"},
+		{"no module", "go 1.12\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			writeFiles(t, dir, map[string]string{"go.mod": tt.gomod})
+
+			if got := goModule(filepath.Join(dir, "go.mod")); got != tt.want {
+				t.Errorf("goModule() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if got := goModule("missing/go.mod"); got != "" {
+		t.Errorf("goModule() of missing file = %q, want empty", got)
+	}
+}
+
+func TestProject_Config(t *testing.T) {
+	// The generated config is loaded as the detected tasks.
+	tests := []struct {
+		name  string
+		files map[string]string
+	}{
+		{"go", map[string]string{"go.mod": "module example.com/x", "cmd/api/main.go": "", "cmd/worker/main.go": "", "bin/x": ""}},
+		{"go and assets", map[string]string{"main.go": "", "package.json": `{"scripts": {"build": "vite build"}}`, "web/app.ts": ""}},
+		{"Makefile", map[string]string{"main.go": "", "Makefile": "generate:\n\tgo generate\nrun:\n\tgo run .\n"}},
+		{"nothing", map[string]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := tempDir(t)
+			defer os.RemoveAll(dir)
+			writeFiles(t, dir, tt.files)
+
+			p := detectProject(dir)
+			config := p.config()
+			v := readConfig(t, config)
+			opt := &goemon.Option{}
+			opt.Default()
+			tasks, err := loadTasks(v, opt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tasks) != len(p.tasks) {
+				t.Fatalf("loadTasks() = %d tasks, want %d", len(tasks), len(p.tasks))
+			}
+			byName := make(map[string]*goemon.Task)
+			for _, task := range tasks {
+				byName[task.Name] = task
+			}
+			for _, want := range p.tasks {
+				got, ok := byName[want.name]
+				if !ok {
+					t.Errorf("task %q is not loaded", want.name)
+					continue
+				}
+				if err := got.Validate(); err != nil {
+					t.Errorf("task %q: %v", want.name, err)
+				}
+				if !reflect.DeepEqual(got.Commands, want.commands) {
+					t.Errorf("task %q commands = %v, want %v", want.name, got.Commands, want.commands)
+				}
+				if !reflect.DeepEqual(got.Option.Watches, want.watches) {
+					t.Errorf("task %q watch = %v, want %v", want.name, got.Option.Watches, want.watches)
+				}
+				if len(want.ext) > 0 && !reflect.DeepEqual(got.Option.Ext, want.ext) {
+					t.Errorf("task %q ext = %v, want %v", want.name, got.Option.Ext, want.ext)
+				}
+				if len(got.Option.Rules) > 0 {
+					t.Errorf("task %q rules = %v, want none", want.name, got.Option.Rules)
+				}
+			}
+			if got, want := v.GetStringSlice("ignore"), p.ignores; len(want) > 0 && !reflect.DeepEqual(got, want) {
+				t.Errorf("ignore = %v, want %v", got, want)
+			}
+			if got := v.GetInt("delay"); got != 500 {
+				t.Errorf("delay = %v, want 500", got)
+			}
+
+			// The example rule of the first task is valid once uncommented.
+			if strings.Contains(config, "    # rules:") {
+				v := readConfig(t, strings.Replace(config, "    # rules:", "    rules:", 1))
+				tasks, err := loadTasks(v, opt)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, task := range tasks {
+					if err := task.Validate(); err != nil {
+						t.Errorf("task %q with the example rule: %v", task.Name, err)
+					}
+				}
+			}
+		})
+	}
+}
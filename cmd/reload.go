@@ -0,0 +1,110 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+// watchConfig calls fn after the config file is changed, until ctx is done.
+// The directory of the file is watched by backend, since editors may replace the file.
+// Errors of the watcher are reported, and watching goes on.
+func watchConfig(ctx context.Context, file, backend string, fn func()) error {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	w, err := goemon.NewWatcher(backend)
+	if err != nil {
+		fmt.Printf("[goemon] %v, falling back to %v watcher\n", err, goemon.BackendPoll)
+		w, _ = goemon.NewWatcher(goemon.BackendPoll)
+	}
+	defer w.Close()
+	if err := w.Add(filepath.Dir(abs)); err != nil {
+		return err
+	}
+
+	d := goemon.NewDebouncer(100*time.Millisecond, func(goemon.ChangeSet) { fn() })
+	defer d.Stop()
+
+	started := make(chan error, 1)
+	go func() {
+		started <- w.Start()
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-started:
+			return err
+		case ev, ok := <-w.Events():
+			if !ok {
+				return nil
+			}
+			if ev.Path == abs || ev.OldPath == abs {
+				d.Add(ev)
+			}
+		case err := <-w.Errors():
+			fmt.Printf("[goemon] watching %v: %v\n", file, err)
+			if err == goemon.ErrOverflow {
+				// Changes of the file may be lost.
+				d.Add(goemon.FileEvent{Op: goemon.Write, Path: abs, ModTime: time.Now()})
+			}
+		}
+	}
+}
+
+// reloadConfig reads the config file again, and applies the tasks of it to gr.
+// named tells whether args are task names rather than commands.
+// The running tasks are kept if the config is invalid.
+func reloadConfig(cmd *cobra.Command, file string, args []string, named bool, gr *goemon.Group) {
+	v := viper.New()
+	v.SetConfigFile(file)
+	bindEnv(v)
+	v.BindPFlags(cmd.Flags())
+	if err := v.ReadInConfig(); err != nil {
+		fmt.Printf("[goemon] failed to reload %v, keeping the current config: %v\n", file, err)
+		return
+	}
+
+	tasks, err := reloadTasks(cmd, v, args, named)
+	if err != nil {
+		fmt.Printf("[goemon] failed to reload %v, keeping the current config: %v\n", file, err)
+		return
+	}
+	fmt.Println("[goemon] reloaded", file)
+	gr.Apply(tasks)
+}
+
+// reloadTasks returns the tasks of the reloaded config v to run by args.
+// If args were task names, all of them must still be tasks of the config,
+// so that they are not run as commands.
+func reloadTasks(cmd *cobra.Command, v *viper.Viper, args []string, named bool) ([]*goemon.Task, error) {
+	opt := &goemon.Option{}
+	opt.Default()
+	readOption(cmd, v, opt)
+	tasks, err := buildTasks(v, opt, args)
+	if err != nil || !named {
+		return tasks, err
+	}
+	found := make(map[string]bool)
+	for _, t := range tasks {
+		found[t.Name] = true
+	}
+	missing := make([]string, 0)
+	for _, arg := range args {
+		if !found[arg] {
+			missing = append(missing, arg)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("unknown tasks %q", missing)
+	}
+	return tasks, nil
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+func TestWatchConfig(t *testing.T) {
+	for _, backend := range []string{goemon.BackendNative, goemon.BackendPoll} {
+		t.Run(backend, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "goemon_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			file := filepath.Join(tmpDir, "goemon.yaml")
+			if err := ioutil.WriteFile(file, []byte("delay: 100"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			reloaded := make(chan struct{}, 1)
+			done := make(chan error)
+			go func() {
+				done <- watchConfig(ctx, file, backend, func() { reloaded <- struct{}{} })
+			}()
+			time.Sleep(300 * time.Millisecond)
+
+			if err := ioutil.WriteFile(filepath.Join(tmpDir, "other.yaml"), []byte("delay: 100"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(file, []byte("delay: 200"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case <-reloaded:
+			case <-time.After(3 * time.Second):
+				t.Fatal("fn is not called after the config file changed")
+			}
+			select {
+			case <-reloaded:
+				t.Error("fn is called more than once")
+			case <-time.After(500 * time.Millisecond):
+			}
+
+			cancel()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Errorf("watchConfig() error = %v", err)
+				}
+			case <-time.After(3 * time.Second):
+				t.Fatal("watchConfig() did not return after the context is done")
+			}
+		})
+	}
+}
+
+func TestBindEnv(t *testing.T) {
+	for k, val := range map[string]string{"SHELL": "/bin/false", "ENV": "/root/.shrc", "GOEMON_STOP_TIMEOUT": "100", "GOEMON_DIR": "web"} {
+		old, ok := os.LookupEnv(k)
+		os.Setenv(k, val)
+		if ok {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+	}
+
+	v := viper.New()
+	v.BindPFlags(NewCmdRoot().Flags())
+	bindEnv(v)
+
+	tests := []struct {
+		key  string
+		get  func(key string) interface{}
+		want interface{}
+	}{
+		{"shell", func(key string) interface{} { return v.GetString(key) }, "sh"},
+		{"env", func(key string) interface{} { return v.GetStringSlice(key) }, []string{}},
+		{"stop-timeout", func(key string) interface{} { return v.GetInt(key) }, 100},
+		{"dir", func(key string) interface{} { return v.GetString(key) }, "web"},
+	}
+	for _, tt := range tests {
+		if got := tt.get(tt.key); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v = %#v, want %#v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestReloadTasks(t *testing.T) {
+	config := `
+tasks:
+  api:
+    commands: ["go run ./cmd/api"]
+  web:
+    commands: ["npm start"]
+`
+	tests := []struct {
+		name    string
+		config  string
+		args    []string
+		named   bool
+		want    []string
+		wantErr bool
+	}{
+		{"all tasks", config, nil, false, []string{"api", "web"}, false},
+		{"named task", config, []string{"web"}, true, []string{"web"}, false},
+		{"removed task", "tasks:\n  web:\n    commands: [a]", []string{"api"}, true, nil, true},
+		{"one of tasks removed", "tasks:\n  web:\n    commands: [a]", []string{"api", "web"}, true, nil, true},
+		{"no tasks left", "commands: [make]", []string{"api"}, true, nil, true},
+		{"commands", config, []string{"make"}, false, []string{""}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd := NewCmdRoot()
+			v := readConfig(t, tt.config)
+			v.BindPFlags(cmd.Flags())
+			tasks, err := reloadTasks(cmd, v, tt.args, tt.named)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reloadTasks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := make([]string, 0)
+			for _, task := range tasks {
+				got = append(got, task.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reloadTasks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
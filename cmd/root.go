@@ -1,9 +1,12 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -19,66 +22,180 @@ func NewCmdRoot() *cobra.Command {
 	opt.Default()
 
 	cmd := &cobra.Command{
-		Use:   "goemon \"command to run\"",
+		Use:   "goemon [\"command to run\"... | task...]",
 		Short: "Monitoring files and run commands",
 		Long:  `Filewatcher`,
-		Args:  cobra.MinimumNArgs(1),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 && len(viper.GetStringSlice("commands")) == 0 && len(viper.GetStringMap("tasks")) == 0 {
+				return fmt.Errorf("requires at least 1 command to run")
+			}
+			return nil
+		},
 		// Uncomment the following line if your bare application
 		// has an action associated with it:
-		Run: func(cmd *cobra.Command, args []string) {
-			opt.Delay = viper.GetInt("delay")
-			opt.Ext = viper.GetStringSlice("ext")
-			opt.Watches = viper.GetStringSlice("watch")
-			opt.Ignores = viper.GetStringSlice("ignore")
-			opt.PrintWatches = viper.GetBool("print")
-			opt.Verbose = viper.GetBool("verbose")
+		RunE: func(cmd *cobra.Command, args []string) error {
+			readOption(cmd, viper.GetViper(), opt)
+			tasks, err := buildTasks(viper.GetViper(), opt, args)
+			if err != nil {
+				return err
+			}
 
 			fmt.Println(opt)
-			g := goemon.New(args, opt)
-			done := make(chan error)
+			gr := goemon.NewGroup(tasks)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			if file := viper.ConfigFileUsed(); file != "" {
+				// Task names of args stay task names after reloading.
+				named := len(args) > 0 && tasks[0].Name != ""
+				go func() {
+					err := watchConfig(ctx, file, opt.Backend, func() {
+						reloadConfig(cmd, file, args, named, gr)
+					})
+					if err != nil {
+						fmt.Printf("[goemon] failed to watch %v: %v\n", file, err)
+					}
+				}()
+			}
+
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+			defer signal.Stop(sig)
 			go func() {
-				err := g.Start()
-				if err != nil {
-					fmt.Println(err)
+				select {
+				case s := <-sig:
+					if opt.Verbose {
+						fmt.Println("[goemon] recieved signal", s)
+					}
+					cancel()
+				case <-ctx.Done():
 				}
-				close(done)
 			}()
 
-			sig := make(chan os.Signal)
-			signal.Notify(sig, os.Interrupt, os.Kill)
-
-			select {
-			case s := <-sig:
-				if opt.Verbose {
-					fmt.Println("[goemon] recieved signal", s)
-				}
-			case <-done:
-				if opt.Verbose {
-					fmt.Println("[goemon] exited")
-				}
+			err = gr.Run(ctx)
+			if opt.Verbose {
+				fmt.Println("[goemon] exited")
 			}
-
-			g.Close()
+			return err
 		},
 	}
 	cobra.OnInitialize(initConfig)
+	cmd.AddCommand(NewCmdInit())
 
 	cmd.Flags().StringVar(&cfgFile, "config", "", "config file (default is ./goemon.yaml)")
-	cmd.Flags().UintP("delay", "d", 2000, "Delay")
+	cmd.Flags().UintP("delay", "d", 2000, "Quiet period in milliseconds to wait after the last change before restarting")
 	viper.BindPFlag("delay", cmd.Flags().Lookup("delay"))
-	cmd.Flags().StringSliceP("ext", "e", []string{}, "specify extentions")
+	cmd.Flags().StringSliceP("ext", "e", []string{}, "Extensions of files which trigger a restart (default all files)")
 	viper.BindPFlag("ext", cmd.Flags().Lookup("ext"))
-	cmd.Flags().StringSliceP("watch", "w", []string{"."}, "watch files or directory")
+	cmd.Flags().StringSlice("basename", []string{}, "Base name patterns of files which trigger a restart in addition to --ext, like Makefile or Dockerfile*")
+	viper.BindPFlag("basename", cmd.Flags().Lookup("basename"))
+	cmd.Flags().StringSlice("ops", []string{}, "File operations which trigger a restart: create, write, remove, rename, move, chmod, prefix with ! to exclude (default all)")
+	viper.BindPFlag("ops", cmd.Flags().Lookup("ops"))
+	cmd.Flags().StringSliceP("watch", "w", []string{"."}, "watch files or directory, prefix with ! to exclude; the last matching pattern wins")
 	viper.BindPFlag("watch", cmd.Flags().Lookup("watch"))
-	cmd.Flags().StringSliceP("ignore", "i", []string{""}, "ignore files or directory")
+	cmd.Flags().StringSliceP("ignore", "i", []string{""}, "ignore files or directory, prefix with ! to include again; the last matching pattern wins")
 	viper.BindPFlag("ignore", cmd.Flags().Lookup("ignore"))
+	cmd.Flags().Bool("gitignore", false, "Ignore files by .gitignore files and .git/info/exclude (.goemonignore files are always used)")
+	viper.BindPFlag("gitignore", cmd.Flags().Lookup("gitignore"))
+	cmd.Flags().Bool("hash", false, "Restart only if the content of a file changed, skipping no-op writes, touches and chmods")
+	viper.BindPFlag("hash", cmd.Flags().Lookup("hash"))
+	cmd.Flags().Int("hash-max-size", 1<<20, "Maximum size in bytes of files to hash with --hash, larger files always count as changed")
+	viper.BindPFlag("hash-max-size", cmd.Flags().Lookup("hash-max-size"))
 	cmd.Flags().BoolP("print", "p", false, "Print watch files")
 	viper.BindPFlag("print", cmd.Flags().Lookup("print"))
 	cmd.Flags().BoolP("verbose", "v", false, "Print verbose command event")
 	viper.BindPFlag("verbose", cmd.Flags().Lookup("verbose"))
+	cmd.Flags().String("backend", goemon.BackendNative, "File watcher backend: native (inotify on Linux) or poll")
+	viper.BindPFlag("backend", cmd.Flags().Lookup("backend"))
+	cmd.Flags().BoolP("sequential", "s", false, "Run commands in order, aborting on failure; only the last one is kept running")
+	viper.BindPFlag("sequential", cmd.Flags().Lookup("sequential"))
+	cmd.Flags().Bool("cancel-stale", false, "Cancel running steps of --sequential commands when newer changes arrive")
+	viper.BindPFlag("cancel-stale", cmd.Flags().Lookup("cancel-stale"))
+	cmd.Flags().StringSliceP("name", "n", []string{}, "Names of commands used as output prefix, in the order of commands")
+	viper.BindPFlag("name", cmd.Flags().Lookup("name"))
+	cmd.Flags().StringArray("rule", []string{}, `Rule mapping file patterns to actions, "patterns [on operations] -> actions", like '*.scss -> run "make css" then restart api'`)
+	cmd.Flags().String("color", goemon.ColorAuto, "Colorize output prefix: auto, always or never")
+	viper.BindPFlag("color", cmd.Flags().Lookup("color"))
+	cmd.Flags().Uint("log-lines", 1000, "Number of recent output lines kept per command")
+	viper.BindPFlag("log-lines", cmd.Flags().Lookup("log-lines"))
+	cmd.Flags().String("dir", "", "Working directory of commands")
+	viper.BindPFlag("dir", cmd.Flags().Lookup("dir"))
+	cmd.Flags().StringSlice("env", []string{}, "Environment variables of commands in the form KEY=value")
+	viper.BindPFlag("env", cmd.Flags().Lookup("env"))
+	cmd.Flags().String("shell", "sh", "Shell which runs commands with -c, like \"bash -o pipefail\"")
+	viper.BindPFlag("shell", cmd.Flags().Lookup("shell"))
+	cmd.Flags().Bool("exec", false, "Run commands directly without a shell")
+	viper.BindPFlag("exec", cmd.Flags().Lookup("exec"))
+	cmd.Flags().Bool("template", false, "Expand commands as templates of the changes, like \"golangci-lint run {{.Dirs}}\"")
+	viper.BindPFlag("template", cmd.Flags().Lookup("template"))
+	cmd.Flags().String("ready", "", "Readiness probe of commands: tcp://host:port, http(s)://url or log:regexp")
+	viper.BindPFlag("ready", cmd.Flags().Lookup("ready"))
+	cmd.Flags().Uint("ready-timeout", 30000, "Milliseconds to wait for commands to become ready")
+	viper.BindPFlag("ready-timeout", cmd.Flags().Lookup("ready-timeout"))
+	cmd.Flags().String("stop-signal", "SIGINT", "Signal sent to stop commands")
+	viper.BindPFlag("stop-signal", cmd.Flags().Lookup("stop-signal"))
+	cmd.Flags().Uint("stop-timeout", 5000, "Milliseconds to wait after the stop signal before killing commands")
+	viper.BindPFlag("stop-timeout", cmd.Flags().Lookup("stop-timeout"))
+	cmd.Flags().String("restart", goemon.RestartNever, "Restart policy when a command exits by itself: never, on-failure or always")
+	viper.BindPFlag("restart", cmd.Flags().Lookup("restart"))
+	cmd.Flags().Uint("restart-retries", 0, "Give up after this many consecutive restarts (0 means unlimited)")
+	viper.BindPFlag("restart-retries", cmd.Flags().Lookup("restart-retries"))
+	cmd.Flags().Uint("restart-backoff", 1000, "Milliseconds to wait before the first restart, doubled on each retry")
+	viper.BindPFlag("restart-backoff", cmd.Flags().Lookup("restart-backoff"))
+	cmd.Flags().Uint("restart-max-backoff", 30000, "Maximum milliseconds to wait between restarts")
+	viper.BindPFlag("restart-max-backoff", cmd.Flags().Lookup("restart-max-backoff"))
+	cmd.Flags().Uint("restart-reset", 10000, "Reset the retry count once a command has run this many milliseconds")
+	viper.BindPFlag("restart-reset", cmd.Flags().Lookup("restart-reset"))
+	cmd.Flags().Uint("crash-loop-count", 5, "Pause a command after it fails this many times in a row, each within the crash loop window after it started")
+	viper.BindPFlag("crash-loop-count", cmd.Flags().Lookup("crash-loop-count"))
+	cmd.Flags().Uint("crash-loop-window", 10000, "Crash loop detection window in milliseconds; failures of commands which ran longer start a new count")
+	viper.BindPFlag("crash-loop-window", cmd.Flags().Lookup("crash-loop-window"))
 	return cmd
 }
 
+// readOption reads the option values of the flags and the config.
+func readOption(cmd *cobra.Command, v *viper.Viper, opt *goemon.Option) {
+	opt.Delay = v.GetInt("delay")
+	opt.Ext = v.GetStringSlice("ext")
+	opt.Basenames = v.GetStringSlice("basename")
+	opt.Ops = v.GetStringSlice("ops")
+	opt.Watches = v.GetStringSlice("watch")
+	opt.Ignores = v.GetStringSlice("ignore")
+	opt.GitIgnore = v.GetBool("gitignore")
+	opt.Hash = v.GetBool("hash")
+	opt.HashMaxSize = v.GetInt("hash-max-size")
+	opt.PrintWatches = v.GetBool("print")
+	opt.Verbose = v.GetBool("verbose")
+	opt.Backend = v.GetString("backend")
+	opt.Sequential = v.GetBool("sequential")
+	opt.CancelStale = v.GetBool("cancel-stale")
+	opt.Names = v.GetStringSlice("name")
+	opt.Rules = v.GetStringSlice("rules")
+	// Rules may contain commas, which viper splits.
+	if cmd.Flags().Changed("rule") {
+		opt.Rules, _ = cmd.Flags().GetStringArray("rule")
+	}
+	opt.Color = v.GetString("color")
+	opt.LogLines = v.GetInt("log-lines")
+	opt.Dir = v.GetString("dir")
+	opt.Env = v.GetStringSlice("env")
+	opt.Shell = v.GetString("shell")
+	opt.Exec = v.GetBool("exec")
+	opt.Template = v.GetBool("template")
+	opt.ReadyProbe = v.GetString("ready")
+	opt.ReadyTimeout = v.GetInt("ready-timeout")
+	opt.StopSignal = v.GetString("stop-signal")
+	opt.StopTimeout = v.GetInt("stop-timeout")
+	opt.Restart = v.GetString("restart")
+	opt.RestartRetries = v.GetInt("restart-retries")
+	opt.RestartBackoff = v.GetInt("restart-backoff")
+	opt.RestartMaxBackoff = v.GetInt("restart-max-backoff")
+	opt.RestartReset = v.GetInt("restart-reset")
+	opt.CrashLoopCount = v.GetInt("crash-loop-count")
+	opt.CrashLoopWindow = v.GetInt("crash-loop-window")
+}
+
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() (exitCode int) {
@@ -100,7 +217,7 @@ func initConfig() {
 		viper.AddConfigPath(".")      // adding current directory as first search path
 		viper.SetConfigName("goemon") // name of config file (without extension)
 	}
-	viper.AutomaticEnv() // read in environment variables that match
+	bindEnv(viper.GetViper()) // read in environment variables that match
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
@@ -108,3 +225,11 @@ func initConfig() {
 		fmt.Println(viper.AllSettings())
 	}
 }
+
+// bindEnv reads options of v from environment variables prefixed with GOEMON_,
+// like GOEMON_STOP_TIMEOUT, so that variables like SHELL are not taken as options.
+func bindEnv(v *viper.Viper) {
+	v.SetEnvPrefix("goemon")
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+}
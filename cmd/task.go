@@ -0,0 +1,219 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/gobwas/glob"
+	"github.com/spf13/viper"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+// loadTasks reads the tasks of the config, like
+//
+//	tasks:
+//	  api:
+//	    commands: ["go run ./cmd/api"]
+//	    watch: [cmd/api, internal]
+//	    ext: [go]
+//	    env: [PORT=8080]
+//	  assets:
+//	    commands: ["npm run build"]
+//	    watch: [web]
+//	    ext: [js, scss]
+//	    delay: 200
+//
+// Options of a task override the ones of base, lists included. Tasks are
+// sorted by name.
+func loadTasks(v *viper.Viper, base *goemon.Option) ([]*goemon.Task, error) {
+	names := make([]string, 0)
+	for name := range v.GetStringMap("tasks") {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	tasks := make([]*goemon.Task, 0, len(names))
+	for _, name := range names {
+		if !taskNameRe.MatchString(name) {
+			return nil, fmt.Errorf("invalid task name %q, must consist of letters, digits, \"_\" and \"-\"", name)
+		}
+		tv := v.Sub("tasks." + name)
+		if tv == nil {
+			return nil, fmt.Errorf("task %q must be a map of options", name)
+		}
+		opt, err := taskOption(tv, base)
+		if err != nil {
+			return nil, fmt.Errorf("task %q: %v", name, err)
+		}
+		tasks = append(tasks, &goemon.Task{
+			Name:     name,
+			Commands: tv.GetStringSlice("commands"),
+			Option:   opt,
+		})
+	}
+	return tasks, nil
+}
+
+// taskNameRe matches valid task names. Config keys are lowercased.
+var taskNameRe = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// taskKeys maps the option keys of a task to the fields of Option they set.
+var taskKeys = map[string]func(o *goemon.Option) interface{}{
+	"delay":               func(o *goemon.Option) interface{} { return &o.Delay },
+	"ext":                 func(o *goemon.Option) interface{} { return &o.Ext },
+	"basename":            func(o *goemon.Option) interface{} { return &o.Basenames },
+	"ops":                 func(o *goemon.Option) interface{} { return &o.Ops },
+	"watch":               func(o *goemon.Option) interface{} { return &o.Watches },
+	"ignore":              func(o *goemon.Option) interface{} { return &o.Ignores },
+	"gitignore":           func(o *goemon.Option) interface{} { return &o.GitIgnore },
+	"hash":                func(o *goemon.Option) interface{} { return &o.Hash },
+	"hash-max-size":       func(o *goemon.Option) interface{} { return &o.HashMaxSize },
+	"print":               func(o *goemon.Option) interface{} { return &o.PrintWatches },
+	"verbose":             func(o *goemon.Option) interface{} { return &o.Verbose },
+	"backend":             func(o *goemon.Option) interface{} { return &o.Backend },
+	"sequential":          func(o *goemon.Option) interface{} { return &o.Sequential },
+	"cancel-stale":        func(o *goemon.Option) interface{} { return &o.CancelStale },
+	"name":                func(o *goemon.Option) interface{} { return &o.Names },
+	"rules":               func(o *goemon.Option) interface{} { return &o.Rules },
+	"color":               func(o *goemon.Option) interface{} { return &o.Color },
+	"log-lines":           func(o *goemon.Option) interface{} { return &o.LogLines },
+	"dir":                 func(o *goemon.Option) interface{} { return &o.Dir },
+	"env":                 func(o *goemon.Option) interface{} { return &o.Env },
+	"shell":               func(o *goemon.Option) interface{} { return &o.Shell },
+	"exec":                func(o *goemon.Option) interface{} { return &o.Exec },
+	"template":            func(o *goemon.Option) interface{} { return &o.Template },
+	"ready":               func(o *goemon.Option) interface{} { return &o.ReadyProbe },
+	"ready-timeout":       func(o *goemon.Option) interface{} { return &o.ReadyTimeout },
+	"stop-signal":         func(o *goemon.Option) interface{} { return &o.StopSignal },
+	"stop-timeout":        func(o *goemon.Option) interface{} { return &o.StopTimeout },
+	"restart":             func(o *goemon.Option) interface{} { return &o.Restart },
+	"restart-retries":     func(o *goemon.Option) interface{} { return &o.RestartRetries },
+	"restart-backoff":     func(o *goemon.Option) interface{} { return &o.RestartBackoff },
+	"restart-max-backoff": func(o *goemon.Option) interface{} { return &o.RestartMaxBackoff },
+	"restart-reset":       func(o *goemon.Option) interface{} { return &o.RestartReset },
+	"crash-loop-count":    func(o *goemon.Option) interface{} { return &o.CrashLoopCount },
+	"crash-loop-window":   func(o *goemon.Option) interface{} { return &o.CrashLoopWindow },
+}
+
+// taskOption returns the option of a task, overriding base by the values set in v.
+// Keys other than commands and taskKeys are rejected.
+func taskOption(v *viper.Viper, base *goemon.Option) (*goemon.Option, error) {
+	opt := *base
+	opt.Ignores = append([]string{}, base.Ignores...)
+	opt.Env = append([]string{}, base.Env...)
+	// Names of the base commands do not apply to the task.
+	opt.Names = nil
+
+	keys := v.AllKeys()
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key == "commands" {
+			continue
+		}
+		field, ok := taskKeys[key]
+		if !ok {
+			return nil, fmt.Errorf("unknown option %q", key)
+		}
+		switch f := field(&opt).(type) {
+		case *int:
+			*f = v.GetInt(key)
+		case *bool:
+			*f = v.GetBool(key)
+		case *string:
+			*f = v.GetString(key)
+		case *[]string:
+			*f = v.GetStringSlice(key)
+		}
+	}
+	return &opt, nil
+}
+
+// buildTasks returns the validated tasks to run by args, which are task
+// names or commands. Without tasks in the config, commands of args or the
+// config are run as an unnamed task of opt.
+func buildTasks(v *viper.Viper, opt *goemon.Option, args []string) ([]*goemon.Task, error) {
+	tasks, err := loadTasks(v, opt)
+	if err != nil {
+		return nil, err
+	}
+	tasks, ok, err := selectTasks(tasks, args)
+	if err != nil {
+		return nil, err
+	}
+	if !ok || len(tasks) == 0 {
+		if len(args) == 0 {
+			args = v.GetStringSlice("commands")
+		}
+		tasks = []*goemon.Task{{Commands: args, Option: opt}}
+	}
+	for _, t := range tasks {
+		if err := t.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	// Changes of the config file are applied by reloading it, not by restarting tasks.
+	if file := configPattern(v); file != "" {
+		for _, t := range tasks {
+			t.Option.Ignores = append(t.Option.Ignores, file)
+		}
+	}
+	return tasks, nil
+}
+
+// configPattern returns the ignore pattern of the config file in use,
+// or "" if no config file is used.
+func configPattern(v *viper.Viper) string {
+	file := v.ConfigFileUsed()
+	if file == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return ""
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(wd, abs)
+	if err != nil {
+		return ""
+	}
+	return glob.QuoteMeta(rel)
+}
+
+// selectTasks returns the tasks named by args, or all of them if args are empty.
+// It returns false if args are not task names but commands.
+func selectTasks(tasks []*goemon.Task, args []string) ([]*goemon.Task, bool, error) {
+	if len(args) == 0 {
+		return tasks, true, nil
+	}
+	byName := make(map[string]*goemon.Task)
+	for _, t := range tasks {
+		byName[t.Name] = t
+	}
+	selected := make([]*goemon.Task, 0, len(args))
+	unknown := make([]string, 0)
+	for _, arg := range args {
+		if t, ok := byName[arg]; ok {
+			if t != nil {
+				selected = append(selected, t)
+			}
+			// Select once.
+			byName[arg] = nil
+		} else {
+			unknown = append(unknown, arg)
+		}
+	}
+	switch {
+	case len(selected) == 0:
+		return nil, false, nil
+	case len(unknown) > 0:
+		return nil, false, fmt.Errorf("unknown tasks %q", unknown)
+	}
+	return selected, true, nil
+}
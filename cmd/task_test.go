@@ -0,0 +1,270 @@
+package cmd
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+// readConfig reads the YAML config.
+func readConfig(t *testing.T, config string) *viper.Viper {
+	t.Helper()
+	v := viper.New()
+	v.SetConfigType("yaml")
+	if err := v.ReadConfig(bytes.NewBufferString(config)); err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestTaskOption(t *testing.T) {
+	base := &goemon.Option{Env: []string{"A=1"}}
+	base.Default()
+
+	tests := []struct {
+		name   string
+		config string
+		get    func(o *goemon.Option) interface{}
+		want   interface{}
+	}{
+		{"stop-timeout", "stop-timeout: 100", func(o *goemon.Option) interface{} { return o.StopTimeout }, 100},
+		{"stop-timeout inherited", "delay: 1", func(o *goemon.Option) interface{} { return o.StopTimeout }, base.StopTimeout},
+		{"stop-signal", "stop-signal: SIGTERM", func(o *goemon.Option) interface{} { return o.StopSignal }, "SIGTERM"},
+		{"shell", "shell: bash -o pipefail", func(o *goemon.Option) interface{} { return o.Shell }, "bash -o pipefail"},
+		{"shell inherited", "delay: 1", func(o *goemon.Option) interface{} { return o.Shell }, base.Shell},
+		{"exec", "exec: true", func(o *goemon.Option) interface{} { return o.Exec }, true},
+		{"template", "template: true", func(o *goemon.Option) interface{} { return o.Template }, true},
+		{"dir", "dir: web", func(o *goemon.Option) interface{} { return o.Dir }, "web"},
+		{"ready", "ready: tcp://:8080", func(o *goemon.Option) interface{} { return o.ReadyProbe }, "tcp://:8080"},
+		{"ready-timeout", "ready-timeout: 1000", func(o *goemon.Option) interface{} { return o.ReadyTimeout }, 1000},
+		{"ready-timeout inherited", "delay: 1", func(o *goemon.Option) interface{} { return o.ReadyTimeout }, base.ReadyTimeout},
+		{"env overrides", "env: [PORT=8080]", func(o *goemon.Option) interface{} { return o.Env }, []string{"PORT=8080"}},
+		{"env inherited", "delay: 1", func(o *goemon.Option) interface{} { return o.Env }, []string{"A=1"}},
+		{"ignore overrides", "ignore: [dist]", func(o *goemon.Option) interface{} { return o.Ignores }, []string{"dist"}},
+		{"ignore inherited", "delay: 1", func(o *goemon.Option) interface{} { return o.Ignores }, base.Ignores},
+		{"name not inherited", "delay: 1", func(o *goemon.Option) interface{} { return o.Names }, []string(nil)},
+		{"hash", "hash: true", func(o *goemon.Option) interface{} { return o.Hash }, true},
+		{"restart-retries", "restart-retries: 3", func(o *goemon.Option) interface{} { return o.RestartRetries }, 3},
+		{"crash-loop-window", "crash-loop-window: 100", func(o *goemon.Option) interface{} { return o.CrashLoopWindow }, 100},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt, err := taskOption(readConfig(t, tt.config), base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.get(opt); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("taskOption() %v = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTaskOption_UnknownKey(t *testing.T) {
+	base := &goemon.Option{}
+	base.Default()
+	for _, config := range []string{"delays: 1", "rule: ['*.go -> restart api']", "env: {PORT: 8080}"} {
+		if _, err := taskOption(readConfig(t, config), base); err == nil {
+			t.Errorf("taskOption(%q) error = nil, want unknown option", config)
+		}
+	}
+}
+
+func TestTaskOption_Keys(t *testing.T) {
+	// Every option of the command line can be set per task.
+	flags := map[string]string{"rules": "rule"}
+	cmd := NewCmdRoot()
+	for key := range taskKeys {
+		name := key
+		if v, ok := flags[key]; ok {
+			name = v
+		}
+		if cmd.Flags().Lookup(name) == nil {
+			t.Errorf("task option %q is not a flag", key)
+		}
+	}
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		switch f.Name {
+		case "config", "rule", "help":
+			return
+		}
+		if _, ok := taskKeys[f.Name]; !ok {
+			t.Errorf("flag %q is not a task option", f.Name)
+		}
+	})
+}
+
+func TestLoadTasks(t *testing.T) {
+	base := &goemon.Option{Env: []string{"A=1"}}
+	base.Default()
+
+	tests := []struct {
+		name    string
+		config  string
+		want    []string
+		wantErr bool
+	}{
+		{"no tasks", "delay: 100", []string{}, false},
+		{"sorted", "tasks:\n  web:\n    commands: [a]\n  api:\n    commands: [b]", []string{"api", "web"}, false},
+		{"not a map", "tasks:\n  web: [a]", nil, true},
+		{"unknown option", "tasks:\n  web:\n    commands: [a]\n    delays: 100", nil, true},
+		{"dotted name", "tasks:\n  my.app:\n    commands: [a]", nil, true},
+		{"unsafe name", "tasks:\n  \"my app\":\n    commands: [a]", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tasks, err := loadTasks(readConfig(t, tt.config), base)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadTasks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			got := make([]string, 0)
+			for _, task := range tasks {
+				got = append(got, task.Name)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadTasks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadTasks_Options(t *testing.T) {
+	base := &goemon.Option{Delay: 100, Env: []string{"A=1"}, Ignores: []string{"vendor"}}
+	base.Default()
+	v := readConfig(t, `
+tasks:
+  api:
+    commands: ["go run ./cmd/api"]
+    ext: [go]
+    env: [PORT=8080]
+  web:
+    commands: ["npm run build", "npm run serve"]
+    delay: 200
+`)
+	tasks, err := loadTasks(v, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, web := tasks[0], tasks[1]
+
+	if got, want := api.Commands, []string{"go run ./cmd/api"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("api commands = %v, want %v", got, want)
+	}
+	if got, want := api.Option.Env, []string{"PORT=8080"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("api env = %v, want %v", got, want)
+	}
+	if got, want := api.Option.Delay, 100; got != want {
+		t.Errorf("api delay = %v, want inherited %v", got, want)
+	}
+	if got, want := web.Option.Delay, 200; got != want {
+		t.Errorf("web delay = %v, want %v", got, want)
+	}
+	if got, want := web.Option.Env, []string{"A=1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("web env = %v, want inherited %v", got, want)
+	}
+	if got, want := web.Option.Ignores, base.Ignores; !reflect.DeepEqual(got, want) {
+		t.Errorf("web ignore = %v, want inherited %v", got, want)
+	}
+	// Tasks do not share the lists of base.
+	web.Option.Ignores = append(web.Option.Ignores, "x")
+	if got, want := api.Option.Ignores, base.Ignores; !reflect.DeepEqual(got, want) {
+		t.Errorf("api ignore = %v, want %v", got, want)
+	}
+}
+
+func TestSelectTasks(t *testing.T) {
+	api := &goemon.Task{Name: "api"}
+	web := &goemon.Task{Name: "web"}
+	tasks := []*goemon.Task{api, web}
+
+	tests := []struct {
+		name    string
+		args    []string
+		want    []*goemon.Task
+		wantOK  bool
+		wantErr bool
+	}{
+		{"all", nil, tasks, true, false},
+		{"one", []string{"web"}, []*goemon.Task{web}, true, false},
+		{"in order of args", []string{"web", "api"}, []*goemon.Task{web, api}, true, false},
+		{"once", []string{"api", "api"}, []*goemon.Task{api}, true, false},
+		{"commands", []string{"go test ./..."}, nil, false, false},
+		{"unknown task with task", []string{"api", "apj"}, nil, false, true},
+		{"command with task", []string{"api", "go test ./..."}, nil, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok, err := selectTasks(tasks, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectTasks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if ok != tt.wantOK {
+				t.Errorf("selectTasks() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("selectTasks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildTasks(t *testing.T) {
+	tasksConfig := `
+tasks:
+  api:
+    commands: ["go run ./cmd/api"]
+  web:
+    commands: ["npm start"]
+`
+	tests := []struct {
+		name     string
+		config   string
+		args     []string
+		want     []string
+		commands [][]string
+		wantErr  bool
+	}{
+		{"all tasks", tasksConfig, nil, []string{"api", "web"}, [][]string{{"go run ./cmd/api"}, {"npm start"}}, false},
+		{"named task", tasksConfig, []string{"web"}, []string{"web"}, [][]string{{"npm start"}}, false},
+		{"commands with tasks", tasksConfig, []string{"go test ./..."}, []string{""}, [][]string{{"go test ./..."}}, false},
+		{"task and command", tasksConfig, []string{"api", "go test ./..."}, nil, nil, true},
+		{"commands", "delay: 100", []string{"go test ./..."}, []string{""}, [][]string{{"go test ./..."}}, false},
+		{"commands of config", "commands: [make]", nil, []string{""}, [][]string{{"make"}}, false},
+		{"no commands", "delay: 100", nil, nil, nil, true},
+		{"task without commands", "tasks:\n  api:\n    delay: 100", nil, nil, nil, true},
+		{"invalid task option", "tasks:\n  api:\n    commands: [a]\n    restart: sometimes", nil, nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := &goemon.Option{}
+			opt.Default()
+			tasks, err := buildTasks(readConfig(t, tt.config), opt, tt.args)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("buildTasks() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			names := make([]string, 0)
+			commands := make([][]string, 0)
+			for _, task := range tasks {
+				names = append(names, task.Name)
+				commands = append(commands, task.Commands)
+			}
+			if !reflect.DeepEqual(names, tt.want) {
+				t.Errorf("buildTasks() names = %v, want %v", names, tt.want)
+			}
+			if !reflect.DeepEqual(commands, tt.commands) {
+				t.Errorf("buildTasks() commands = %v, want %v", commands, tt.commands)
+			}
+		})
+	}
+}
@@ -39,7 +39,7 @@ func startHTTPServer() *http.Server {
 }
 
 func main() {
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh,
 		os.Interrupt,
 		os.Kill,
@@ -48,7 +48,7 @@ func main() {
 	srv := startHTTPServer()
 	fmt.Println("[example server] test server started on localhost:8080")
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt, os.Kill)
 
 	sig := <-quit
@@ -0,0 +1,34 @@
+package goemon_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		arg     string
+		want    []string
+		wantErr bool
+	}{
+		{"plain", "go build -o app", []string{"go", "build", "-o", "app"}, false},
+		{"quoted", `echo 'a b' "c \"d\""`, []string{"echo", "a b", `c "d"`}, false},
+		{"escaped space", `ls my\ dir`, []string{"ls", "my dir"}, false},
+		{"empty quote", `echo ''`, []string{"echo", ""}, false},
+		{"unterminated", `echo "a`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := goemon.SplitArgs(tt.arg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("SplitArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("SplitArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package goemon
+
+import (
+	"sync"
+	"time"
+)
+
+// ChangeSet is a set of file changes which triggers a restart.
+// Each path appears once, in the order of its first change.
+type ChangeSet []FileEvent
+
+// add merges ev into the change set.
+func (cs ChangeSet) add(ev FileEvent) ChangeSet {
+	for i := range cs {
+		if cs[i].Path == ev.Path {
+			cs[i].Op |= ev.Op
+			cs[i].IsDir = ev.IsDir
+			cs[i].ModTime = ev.ModTime
+			if ev.OldPath != "" {
+				cs[i].OldPath = ev.OldPath
+			}
+			return cs
+		}
+	}
+	return append(cs, ev)
+}
+
+// Files returns the changed paths.
+func (cs ChangeSet) Files() []string {
+	files := make([]string, 0, len(cs))
+	for _, ev := range cs {
+		files = append(files, ev.Path)
+	}
+	return files
+}
+
+// Debouncer collects file events until no event arrived for a quiet period,
+// then passes them at once to its function.
+type Debouncer struct {
+	mu      sync.Mutex
+	delay   time.Duration
+	fn      func(ChangeSet)
+	timer   *time.Timer
+	pending ChangeSet
+	gen     int
+	stopped bool
+}
+
+// NewDebouncer initializes Debouncer which calls fn after delay of quiet.
+func NewDebouncer(delay time.Duration, fn func(ChangeSet)) *Debouncer {
+	return &Debouncer{delay: delay, fn: fn}
+}
+
+// Add adds ev to the pending change set and restarts the quiet period.
+func (d *Debouncer) Add(ev FileEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.stopped {
+		return
+	}
+	d.pending = d.pending.add(ev)
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+	// A timer which already fired must not flush the newer events.
+	d.gen++
+	gen := d.gen
+	d.timer = time.AfterFunc(d.delay, func() { d.flush(gen) })
+}
+
+// flush passes the pending change set to fn, unless it was added to after gen.
+func (d *Debouncer) flush(gen int) {
+	d.mu.Lock()
+	if gen != d.gen {
+		d.mu.Unlock()
+		return
+	}
+	cs := d.pending
+	d.pending = nil
+	d.timer = nil
+	stopped := d.stopped
+	d.mu.Unlock()
+
+	if stopped || len(cs) == 0 {
+		return
+	}
+	d.fn(cs)
+}
+
+// Stop discards the pending change set.
+func (d *Debouncer) Stop() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.stopped = true
+	d.pending = nil
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+}
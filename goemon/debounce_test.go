@@ -0,0 +1,94 @@
+package goemon_test
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+func TestDebouncer(t *testing.T) {
+	type add struct {
+		after time.Duration
+		op    goemon.Op
+		path  string
+	}
+	tests := []struct {
+		name string
+		adds []add
+		want [][]string
+	}{
+		{
+			"burst",
+			[]add{{0, goemon.Write, "/a"}, {10 * time.Millisecond, goemon.Create, "/b"}, {10 * time.Millisecond, goemon.Write, "/a"}},
+			[][]string{{"/a", "/b"}},
+		},
+		{
+			"keeps extending",
+			[]add{{0, goemon.Write, "/a"}, {30 * time.Millisecond, goemon.Write, "/b"}, {30 * time.Millisecond, goemon.Write, "/c"}},
+			[][]string{{"/a", "/b", "/c"}},
+		},
+		{
+			"quiet in between",
+			[]add{{0, goemon.Write, "/a"}, {150 * time.Millisecond, goemon.Write, "/b"}},
+			[][]string{{"/a"}, {"/b"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var got [][]string
+			d := goemon.NewDebouncer(50*time.Millisecond, func(cs goemon.ChangeSet) {
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, cs.Files())
+			})
+			defer d.Stop()
+
+			for _, a := range tt.adds {
+				time.Sleep(a.after)
+				d.Add(goemon.FileEvent{Op: a.op, Path: a.path})
+			}
+			time.Sleep(150 * time.Millisecond)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Debouncer fired %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDebouncer_MergesOps(t *testing.T) {
+	done := make(chan goemon.ChangeSet, 1)
+	d := goemon.NewDebouncer(10*time.Millisecond, func(cs goemon.ChangeSet) { done <- cs })
+	defer d.Stop()
+
+	d.Add(goemon.FileEvent{Op: goemon.Create, Path: "/a"})
+	d.Add(goemon.FileEvent{Op: goemon.Write, Path: "/a"})
+
+	select {
+	case cs := <-done:
+		if len(cs) != 1 || cs[0].Op != goemon.Create|goemon.Write {
+			t.Errorf("ChangeSet = %v, want single create|write", cs)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Debouncer did not fire")
+	}
+}
+
+func TestDebouncer_Stop(t *testing.T) {
+	fired := make(chan struct{}, 1)
+	d := goemon.NewDebouncer(10*time.Millisecond, func(cs goemon.ChangeSet) { fired <- struct{}{} })
+	d.Add(goemon.FileEvent{Op: goemon.Write, Path: "/a"})
+	d.Stop()
+
+	select {
+	case <-fired:
+		t.Error("Debouncer fired after Stop")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,98 @@
+package goemon
+
+import (
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ProcessEventType is a type of process lifecycle event.
+type ProcessEventType int
+
+// Process lifecycle event types.
+const (
+	// ProcessStarting is published before the command (or the first step of a pipeline) is started.
+	ProcessStarting ProcessEventType = iota
+	// ProcessStarted is published when the long running command is started.
+	ProcessStarted
+	// ProcessReady is published when the readiness probe succeeded, or right after
+	// ProcessStarted if there is no probe. Err is set if the probe timed out.
+	ProcessReady
+	// ProcessExited is published when the command exited, or a pipeline step failed.
+	ProcessExited
+	// ProcessRestarting is published when the command is going to be restarted.
+	ProcessRestarting
+	// ProcessStopped is published when the command is stopped by Stop.
+	ProcessStopped
+)
+
+func (t ProcessEventType) String() string {
+	switch t {
+	case ProcessStarting:
+		return "starting"
+	case ProcessStarted:
+		return "started"
+	case ProcessReady:
+		return "ready"
+	case ProcessExited:
+		return "exited"
+	case ProcessRestarting:
+		return "restarting"
+	case ProcessStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// ProcessEvent is a lifecycle event of Process.
+type ProcessEvent struct {
+	Type     ProcessEventType
+	Process  *Process
+	Time     time.Time
+	PID      int
+	ExitCode int
+	Signal   syscall.Signal
+	Err      error
+}
+
+// eventBufferSize is the channel buffer size of each subscriber.
+// Events are dropped for subscribers which do not keep up.
+const eventBufferSize = 64
+
+// eventHub broadcasts events to subscribers.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[<-chan ProcessEvent]chan ProcessEvent
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[<-chan ProcessEvent]chan ProcessEvent)}
+}
+
+func (h *eventHub) subscribe() <-chan ProcessEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch := make(chan ProcessEvent, eventBufferSize)
+	h.subs[ch] = ch
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch <-chan ProcessEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if c, ok := h.subs[ch]; ok {
+		delete(h.subs, ch)
+		close(c)
+	}
+}
+
+func (h *eventHub) publish(ev ProcessEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range h.subs {
+		select {
+		case c <- ev:
+		default:
+		}
+	}
+}
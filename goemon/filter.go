@@ -0,0 +1,211 @@
+package goemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// Filter decides which paths are watched, by watch and ignore globbing patterns
+// and ignore files in gitignore format.
+//
+// Watch patterns include paths and ignore patterns exclude them, unless they
+// are negated by a leading "!". The last pattern matching a path or any of its
+// parent directories decides, so that
+//
+//	--ignore 'vendor' --ignore '!vendor/github.com/ourorg/**'
+//
+// watches nothing in vendor but the ourorg packages.
+// Paths ignored by ignore files are never watched.
+type Filter struct {
+	root        string
+	rules       []filterRule
+	reinclude   bool
+	gitignore   bool
+	ignoreFiles *IgnoreFiles
+}
+
+// filterRule is a compiled watch or ignore pattern.
+type filterRule struct {
+	glob    glob.Glob
+	include bool
+}
+
+// NewFilter initializes Filter of the paths under root.
+// .goemonignore files are loaded while walking.
+func NewFilter(root string, watches, ignores []string) *Filter {
+	rules := append(compileRules(watches, true), compileRules(ignores, false)...)
+	return newFilter(root, rules)
+}
+
+func newFilter(root string, rules []filterRule) *Filter {
+	f := &Filter{
+		root:        root,
+		rules:       rules,
+		ignoreFiles: NewIgnoreFiles(root),
+	}
+	// Once a pattern includes after an ignore, ignored directories may contain targets.
+	excluded := false
+	for _, r := range rules {
+		excluded = excluded || !r.include
+		if excluded && r.include {
+			f.reinclude = true
+		}
+	}
+	return f
+}
+
+// compileRules compiles patterns which include paths if include is true,
+// or exclude them otherwise. Negated patterns do the opposite.
+func compileRules(patterns []string, include bool) []filterRule {
+	rules := make([]filterRule, 0, len(patterns))
+	for _, p := range patterns {
+		negate := strings.HasPrefix(p, "!")
+		if negate {
+			p = p[1:]
+		}
+		rules = append(rules, filterRule{CompileGlobs([]string{p})[0], include != negate})
+	}
+	return rules
+}
+
+// ValidatePatterns checks patterns can be compiled.
+func ValidatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if _, err := glob.Compile(strings.TrimPrefix(p, "!"), '/', filepath.Separator); err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// SetGitIgnore sets whether .gitignore files and .git/info/exclude are loaded as well.
+func (f *Filter) SetGitIgnore(v bool) {
+	f.gitignore = v
+	if v {
+		f.ignoreFiles.Load(filepath.Join(f.root, gitExcludeFile))
+	}
+}
+
+// matchGlobs reports whether rel or its base name matches any of globs.
+func matchGlobs(globs []glob.Glob, rel string) bool {
+	for _, v := range globs {
+		if v.Match(rel) || v.Match(filepath.Base(rel)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Rel returns path relative to the root.
+func (f *Filter) Rel(path string) string {
+	if !filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	rel, err := filepath.Rel(f.root, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+// decide returns whether the last pattern matching path or any of its parent
+// directories includes it, and whether any pattern matched.
+func (f *Filter) decide(rel string) (include, matched bool) {
+	for _, r := range f.rules {
+		for p := rel; p != "." && p != ".." && p != string(filepath.Separator); p = filepath.Dir(p) {
+			if r.glob.Match(p) || r.glob.Match(filepath.Base(p)) {
+				include, matched = r.include, true
+				break
+			}
+		}
+	}
+	return include, matched
+}
+
+// ignoredByFiles reports whether path or any of its parent directories is ignored by the ignore files.
+func (f *Filter) ignoredByFiles(rel string, isDir bool) bool {
+	for p := rel; p != "." && p != ".." && p != string(filepath.Separator); p = filepath.Dir(p) {
+		if f.ignoreFiles.Match(filepath.ToSlash(p), isDir) {
+			return true
+		}
+		// Parents are directories.
+		isDir = true
+	}
+	return false
+}
+
+// IsIgnored reports whether path is excluded by the ignore patterns or the ignore files.
+func (f *Filter) IsIgnored(path string, isDir bool) bool {
+	rel := f.Rel(path)
+	if include, matched := f.decide(rel); matched && !include {
+		return true
+	}
+	return f.ignoredByFiles(rel, isDir)
+}
+
+// IsTarget reports whether path is a target of watching.
+func (f *Filter) IsTarget(path string, isDir bool) bool {
+	rel := f.Rel(path)
+	include, _ := f.decide(rel)
+	return include && !f.ignoredByFiles(rel, isDir)
+}
+
+// skipDir reports whether nothing below the ignored directory is a target.
+func (f *Filter) skipDir(path string) bool {
+	return !f.reinclude || f.ignoredByFiles(f.Rel(path), true)
+}
+
+// IsIgnoreFile reports whether path is an ignore file which the filter loads.
+func (f *Filter) IsIgnoreFile(path string) bool {
+	switch filepath.Base(path) {
+	case GoemonIgnoreFile:
+		return true
+	case GitIgnoreFile:
+		return f.gitignore
+	}
+	return false
+}
+
+// Reload reloads the ignore file.
+func (f *Filter) Reload(path string) error {
+	return f.ignoreFiles.Load(path)
+}
+
+// Walk walks the paths under root which are not ignored, loading the ignore
+// files of each directory before its contents.
+func (f *Filter) Walk(root string, walkFn func(path string, fi os.FileInfo)) {
+	filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if f.IsIgnored(path, fi.IsDir()) {
+			if fi.IsDir() && f.skipDir(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if fi.IsDir() {
+			f.ignoreFiles.Load(filepath.Join(path, GoemonIgnoreFile))
+			if f.gitignore {
+				f.ignoreFiles.Load(filepath.Join(path, GitIgnoreFile))
+			}
+		}
+		walkFn(path, fi)
+		return nil
+	})
+}
+
+// List lists the target files and directories under the root, relative to the root.
+func (f *Filter) List() map[string]os.FileInfo {
+	targets := make(map[string]os.FileInfo)
+	f.Walk(f.root, func(path string, fi os.FileInfo) {
+		if path != f.root && f.IsTarget(path, fi.IsDir()) {
+			targets[f.Rel(path)] = fi
+		}
+	})
+	return targets
+}
@@ -0,0 +1,193 @@
+package goemon_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+// writeFiles writes files with contents under dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFilter_IgnoreFiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		gitignore bool
+		files     map[string]string
+		want      []string
+	}{
+		{
+			"basename at any depth",
+			true,
+			map[string]string{".gitignore": "*.log\n", "a.go": "", "a.log": "", "sub/b.log": "", "sub/b.go": ""},
+			[]string{".gitignore", "a.go", "sub", "sub/b.go"},
+		},
+		{
+			"negation",
+			true,
+			map[string]string{".gitignore": "*.log\n!keep.log\n", "a.log": "", "keep.log": "", "sub/keep.log": ""},
+			[]string{".gitignore", "keep.log", "sub", "sub/keep.log"},
+		},
+		{
+			"anchored",
+			true,
+			map[string]string{".gitignore": "/build\nsub/gen.go\n", "build/a.go": "", "sub/build/b.go": "", "sub/gen.go": "", "sub/c.go": ""},
+			[]string{".gitignore", "sub", "sub/build", "sub/build/b.go", "sub/c.go"},
+		},
+		{
+			"directory only",
+			true,
+			map[string]string{".gitignore": "out/\n", "out/a.go": "", "src/out": ""},
+			[]string{".gitignore", "src", "src/out"},
+		},
+		{
+			"double star",
+			true,
+			map[string]string{".gitignore": "**/tmp\na/**/z.go\n", "tmp/a.go": "", "x/tmp/b.go": "", "a/z.go": "", "a/b/c/z.go": "", "a/y.go": ""},
+			[]string{".gitignore", "a", "a/b", "a/b/c", "a/y.go", "x"},
+		},
+		{
+			"no reinclusion in excluded directory",
+			true,
+			map[string]string{".gitignore": "logs/\n!logs/keep.log\n", "logs/keep.log": ""},
+			[]string{".gitignore"},
+		},
+		{
+			"comments and escapes",
+			true,
+			map[string]string{".gitignore": "# comment\n\\#hash\n\n{a}\n", "#hash": "", "# comment": "", "{a}": ""},
+			[]string{".gitignore", "# comment"},
+		},
+		{
+			"nested overrides parent",
+			true,
+			map[string]string{".gitignore": "*.gen.go\n", "a.gen.go": "", "api/.gitignore": "!*.gen.go\n/local.go\n", "api/b.gen.go": "", "api/local.go": "", "local.go": ""},
+			[]string{".gitignore", "api", "api/.gitignore", "api/b.gen.go", "local.go"},
+		},
+		{
+			"info exclude",
+			true,
+			map[string]string{".git/info/exclude": "secret.go\n", "secret.go": "", "a.go": ""},
+			[]string{"a.go"},
+		},
+		{
+			"gitignore disabled",
+			false,
+			map[string]string{".gitignore": "*.log\n", ".git/info/exclude": "a.go\n", "a.go": "", "a.log": ""},
+			[]string{".gitignore", "a.go", "a.log"},
+		},
+		{
+			"goemonignore always",
+			false,
+			map[string]string{".goemonignore": "*.log\n", "a.go": "", "a.log": "", "sub/.goemonignore": "*.md\n", "sub/b.md": "", "c.md": ""},
+			[]string{".goemonignore", "a.go", "c.md", "sub", "sub/.goemonignore"},
+		},
+		{
+			"goemonignore over gitignore",
+			true,
+			map[string]string{".gitignore": "*.log\n", ".goemonignore": "!a.log\n", "a.log": "", "b.log": ""},
+			[]string{".gitignore", ".goemonignore", "a.log"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "goemon_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			writeFiles(t, tmpDir, tt.files)
+
+			f := goemon.NewFilter(tmpDir, []string{"."}, []string{".git"})
+			f.SetGitIgnore(tt.gitignore)
+			got := listMapKeys(f.List())
+			if !deepEqualSorted(got, tt.want) {
+				t.Errorf("Filter.List() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilter_Reload(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "goemon_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	writeFiles(t, tmpDir, map[string]string{".goemonignore": "*.log\n", "a.log": "", "a.go": ""})
+
+	f := goemon.NewFilter(tmpDir, []string{"."}, nil)
+	f.List()
+	log, src := filepath.Join(tmpDir, "a.log"), filepath.Join(tmpDir, "a.go")
+	if !f.IsIgnored(log, false) || f.IsIgnored(src, false) {
+		t.Fatal("a.log must be ignored, a.go must not")
+	}
+
+	writeFiles(t, tmpDir, map[string]string{".goemonignore": "*.go\n"})
+	if err := f.Reload(filepath.Join(tmpDir, ".goemonignore")); err != nil {
+		t.Fatal(err)
+	}
+	if f.IsIgnored(log, false) || !f.IsIgnored(src, false) {
+		t.Error("a.go must be ignored, a.log must not after reload")
+	}
+
+	os.Remove(filepath.Join(tmpDir, ".goemonignore"))
+	if err := f.Reload(filepath.Join(tmpDir, ".goemonignore")); err != nil {
+		t.Fatal(err)
+	}
+	if f.IsIgnored(log, false) || f.IsIgnored(src, false) {
+		t.Error("nothing must be ignored after removal")
+	}
+}
+
+func TestFilter_Patterns(t *testing.T) {
+	tmpDir := setup(t)
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name    string
+		watches []string
+		ignores []string
+		want    []string
+	}{
+		{"directory", []string{"hello"}, []string{}, []string{"hello", "hello/hello.go"}},
+		{"reinclude subtree", []string{"."}, []string{".git", "vendor", "cmd", "hello", "!vendor/github.com/somepkg-go/**"},
+			[]string{".env", "Makefile", "README.md", "main.go", "vendor/github.com/somepkg-go/.github", "vendor/github.com/somepkg-go/Makefile", "vendor/github.com/somepkg-go/README.md", "vendor/github.com/somepkg-go/main.go"}},
+		{"last match wins", []string{"*.go"}, []string{"*.go", "!main.go"}, []string{"main.go", "vendor/github.com/somepkg-go/main.go"}},
+		{"ignore after negation", []string{"*.go"}, []string{"!main.go", "*.go"}, []string{}},
+		{"negated watch", []string{"*.go", "!vendor"}, []string{}, []string{"main.go", "cmd/somecmd/root.go", "hello/hello.go"}},
+		{"ignored parent", []string{"*.go"}, []string{"vendor", "!*.go"}, []string{"main.go", "cmd/somecmd/root.go", "hello/hello.go", "vendor/github.com/somepkg-go/main.go"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := goemon.NewFilter(tmpDir, tt.watches, tt.ignores)
+			got := listMapKeys(f.List())
+			if !deepEqualSorted(got, tt.want) {
+				t.Errorf("Filter.List() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidatePatterns(t *testing.T) {
+	if err := goemon.ValidatePatterns([]string{"*.go", "!vendor/**", "{a,b}"}); err != nil {
+		t.Errorf("ValidatePatterns() error = %v", err)
+	}
+	if err := goemon.ValidatePatterns([]string{"!["}); err == nil {
+		t.Error("ValidatePatterns() returns no error for an invalid pattern")
+	}
+}
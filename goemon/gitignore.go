@@ -0,0 +1,220 @@
+package goemon
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gobwas/glob"
+)
+
+// Ignore files.
+const (
+	// GitIgnoreFile is loaded from every directory if Option.GitIgnore is set.
+	GitIgnoreFile = ".gitignore"
+	// GoemonIgnoreFile is loaded from every directory.
+	GoemonIgnoreFile = ".goemonignore"
+)
+
+// gitExcludeFile is loaded with .gitignore files, as the lowest precedence.
+var gitExcludeFile = filepath.Join(".git", "info", "exclude")
+
+// ignorePattern is a pattern of gitignore format.
+type ignorePattern struct {
+	negate   bool
+	dirOnly  bool
+	anchored bool
+	glob     glob.Glob
+}
+
+// parseIgnorePattern parses a line of gitignore format.
+// It reports false for blank lines, comments and invalid patterns.
+func parseIgnorePattern(line string) (ignorePattern, bool) {
+	var p ignorePattern
+
+	line = strings.TrimSuffix(line, "\r")
+	if !strings.HasSuffix(line, `\ `) {
+		line = strings.TrimRight(line, " \t")
+	}
+	if line == "" || strings.HasPrefix(line, "#") {
+		return p, false
+	}
+	if strings.HasPrefix(line, "!") {
+		p.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		p.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// A slash at the beginning or middle anchors the pattern to the directory of the ignore file.
+	p.anchored = strings.Contains(line, "/")
+	line = strings.TrimPrefix(line, "/")
+	if line == "" {
+		return p, false
+	}
+
+	// Braces are literal in gitignore.
+	line = strings.NewReplacer("{", `\{`, "}", `\}`).Replace(line)
+	// "**/" matches zero or more directories.
+	if strings.HasPrefix(line, "**/") {
+		line = "{,**/}" + line[3:]
+	}
+	line = strings.Replace(line, "/**/", "/{,**/}", -1)
+
+	g, err := glob.Compile(line, '/')
+	if err != nil {
+		return p, false
+	}
+	p.glob = g
+	return p, true
+}
+
+// match reports whether the slash-separated path relative to the directory
+// of the ignore file matches the pattern.
+func (p ignorePattern) match(rel string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.anchored {
+		return p.glob.Match(rel)
+	}
+	return p.glob.Match(path.Base(rel))
+}
+
+// ignoreFile is patterns loaded from an ignore file.
+type ignoreFile struct {
+	// base is the slash-separated directory of the ignore file relative to the root, "" for the root.
+	base     string
+	patterns []ignorePattern
+}
+
+// IgnoreFiles matches paths by patterns of ignore files in gitignore format,
+// like git does. Patterns of deeper ignore files take precedence,
+// and the last matching pattern decides in each file.
+type IgnoreFiles struct {
+	mu    sync.Mutex
+	root  string
+	files map[string]*ignoreFile
+	order []*ignoreFile
+}
+
+// NewIgnoreFiles initializes IgnoreFiles of the files under root.
+func NewIgnoreFiles(root string) *IgnoreFiles {
+	return &IgnoreFiles{root: root, files: make(map[string]*ignoreFile)}
+}
+
+// Load loads the ignore file. A missing file is not an error, and unloads
+// the file loaded before.
+func (ig *IgnoreFiles) Load(file string) error {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return err
+	}
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+
+	f, err := os.Open(abs)
+	if os.IsNotExist(err) {
+		ig.unload(abs)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dir := filepath.Dir(abs)
+	if filepath.Base(dir) == "info" && filepath.Base(filepath.Dir(dir)) == ".git" {
+		// .git/info/exclude applies to the work tree.
+		dir = filepath.Dir(filepath.Dir(dir))
+	}
+	base, err := filepath.Rel(ig.root, dir)
+	if err != nil || base == ".." || strings.HasPrefix(base, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	if base == "." {
+		base = ""
+	}
+
+	igf := &ignoreFile{base: filepath.ToSlash(base)}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if p, ok := parseIgnorePattern(s.Text()); ok {
+			igf.patterns = append(igf.patterns, p)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	ig.files[abs] = igf
+	ig.sort()
+	return nil
+}
+
+// unload unloads the file. ig.mu must be held.
+func (ig *IgnoreFiles) unload(abs string) {
+	if _, ok := ig.files[abs]; ok {
+		delete(ig.files, abs)
+		ig.sort()
+	}
+}
+
+// sort orders the files by precedence, lowest first. ig.mu must be held.
+// In the same directory, .goemonignore takes precedence over .gitignore.
+func (ig *IgnoreFiles) sort() {
+	ig.order = ig.order[:0]
+	names := make([]string, 0, len(ig.files))
+	for name := range ig.files {
+		names = append(names, name)
+	}
+	depth := func(name string) int {
+		base := ig.files[name].base
+		switch {
+		case strings.HasSuffix(name, gitExcludeFile):
+			return -1
+		case base == "":
+			return 0
+		}
+		return strings.Count(base, "/") + 1
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if di, dj := depth(names[i]), depth(names[j]); di != dj {
+			return di < dj
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		ig.order = append(ig.order, ig.files[name])
+	}
+}
+
+// Match reports whether the slash-separated path relative to the root is ignored
+// by its own patterns. Parent directories are not checked.
+func (ig *IgnoreFiles) Match(rel string, isDir bool) bool {
+	ig.mu.Lock()
+	defer ig.mu.Unlock()
+
+	ignored := false
+	for _, f := range ig.order {
+		r := rel
+		if f.base != "" {
+			if !strings.HasPrefix(rel, f.base+"/") {
+				continue
+			}
+			r = rel[len(f.base)+1:]
+		}
+		for _, p := range f.patterns {
+			if p.match(r, isDir) {
+				ignored = !p.negate
+			}
+		}
+	}
+	return ignored
+}
@@ -1,15 +1,17 @@
 package goemon
 
 import (
+	"context"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gobwas/glob"
-	"github.com/radovskyb/watcher"
 )
 
 // StartCloser provides start and close.
@@ -22,10 +24,40 @@ type StartCloser interface {
 type Option struct {
 	Delay        int
 	Ext          []string
+	Basenames    []string
+	Ops          []string
 	Watches      []string
 	Ignores      []string
+	GitIgnore    bool
+	Hash         bool
+	HashMaxSize  int
 	PrintWatches bool
 	Verbose      bool
+	Sequential   bool
+	CancelStale  bool
+	Names        []string
+	Rules        []string
+	Color        string
+	LogLines     int
+	Dir          string
+	Env          []string
+	Shell        string
+	Exec         bool
+	Template     bool
+	ReadyProbe   string
+	ReadyTimeout int
+	Backend      string
+	StopSignal   string
+	StopTimeout  int
+
+	Restart           string
+	RestartRetries    int
+	RestartBackoff    int
+	RestartMaxBackoff int
+	RestartReset      int
+
+	CrashLoopCount  int
+	CrashLoopWindow int
 }
 
 // Default sets default option values.
@@ -36,17 +68,171 @@ func (o *Option) Default() {
 	if o.Ext == nil {
 		o.Ext = []string{}
 	}
+	if o.Basenames == nil {
+		o.Basenames = []string{}
+	}
 	if o.Watches == nil {
 		o.Watches = []string{"."}
 	}
 	if o.Ignores == nil {
 		o.Ignores = []string{}
 	}
+	if o.Shell == "" {
+		o.Shell = "sh"
+	}
+	if o.Backend == "" {
+		o.Backend = BackendNative
+	}
+	if o.ReadyTimeout == 0 {
+		o.ReadyTimeout = 30000
+	}
+	if o.HashMaxSize == 0 {
+		o.HashMaxSize = 1 << 20
+	}
+	if o.LogLines == 0 {
+		o.LogLines = 1000
+	}
+	if o.Color == "" {
+		o.Color = ColorAuto
+	}
+	if o.StopSignal == "" {
+		o.StopSignal = "SIGINT"
+	}
+	if o.StopTimeout == 0 {
+		o.StopTimeout = 5000
+	}
+	if o.Restart == "" {
+		o.Restart = RestartNever
+	}
+	if o.RestartBackoff == 0 {
+		o.RestartBackoff = 1000
+	}
+	if o.RestartMaxBackoff == 0 {
+		o.RestartMaxBackoff = 30000
+	}
+	if o.RestartReset == 0 {
+		o.RestartReset = 10000
+	}
+	if o.CrashLoopCount == 0 {
+		o.CrashLoopCount = 5
+	}
+	if o.CrashLoopWindow == 0 {
+		o.CrashLoopWindow = 10000
+	}
 	o.Ignores = append(o.Ignores, ".git", ".git/**")
 }
 
+// Validate checks option values which can not be used as is.
+func (o *Option) Validate() error {
+	if _, err := ParseSignal(o.StopSignal); err != nil {
+		return fmt.Errorf("invalid stop signal: %v", err)
+	}
+	if err := ValidateRestartMode(o.Restart); err != nil {
+		return err
+	}
+	if err := ValidateColorMode(o.Color); err != nil {
+		return err
+	}
+	for _, v := range o.Basenames {
+		if _, err := filepath.Match(v, ""); err != nil {
+			return fmt.Errorf("invalid basename pattern %q: %v", v, err)
+		}
+	}
+	if _, err := ParseOps(o.Ops); err != nil {
+		return err
+	}
+	if err := ValidatePatterns(o.Watches); err != nil {
+		return err
+	}
+	if err := ValidatePatterns(o.Ignores); err != nil {
+		return err
+	}
+	if err := ValidateBackend(o.Backend); err != nil {
+		return err
+	}
+	if _, err := SplitArgs(o.Shell); err != nil {
+		return fmt.Errorf("invalid shell: %v", err)
+	}
+	if o.ReadyProbe != "" {
+		if _, err := ParseProbe(o.ReadyProbe); err != nil {
+			return err
+		}
+	}
+	for _, v := range o.Rules {
+		r, err := ParseRule(v)
+		if err != nil {
+			return err
+		}
+		for _, a := range r.Actions {
+			if a.Kind == ActionRestart && !o.hasName(a.Target) {
+				return fmt.Errorf("unknown command %q in rule %q", a.Target, v)
+			}
+		}
+	}
+	for _, e := range o.Env {
+		if !strings.Contains(e, "=") {
+			return fmt.Errorf("invalid env %q, must be KEY=value", e)
+		}
+	}
+	return nil
+}
+
+// label returns the output label of the i-th of n processes.
+// Processes are labelled by name, or by index if there are multiple processes.
+func (o *Option) label(i, n int) string {
+	if i < len(o.Names) && o.Names[i] != "" {
+		return o.Names[i]
+	}
+	if n > 1 {
+		return strconv.Itoa(i)
+	}
+	return ""
+}
+
+// hasName reports whether name is a name or an index of the commands.
+// Names must have the label of every command, as Task.Validate sets them.
+func (o *Option) hasName(name string) bool {
+	for _, v := range o.Names {
+		if v == name {
+			return true
+		}
+	}
+	i, err := strconv.Atoi(name)
+	return err == nil && i >= 0 && i < len(o.Names)
+}
+
+// configure applies process related options to p.
+func (o *Option) configure(p *Process) {
+	p.SetVerbose(o.Verbose)
+	p.SetLogSize(o.LogLines)
+	p.SetDir(o.Dir)
+	p.SetEnv(o.Env)
+	p.SetShell(o.Shell)
+	p.SetExec(o.Exec)
+	p.SetTemplate(o.Template)
+	p.SetCancelStale(o.CancelStale)
+	if o.ReadyProbe != "" {
+		if probe, err := ParseProbe(o.ReadyProbe); err == nil {
+			p.SetProbe(probe, time.Duration(o.ReadyTimeout)*time.Millisecond)
+		}
+	}
+	if sig, err := ParseSignal(o.StopSignal); err == nil {
+		p.SetStopSignal(sig)
+	}
+	p.SetStopTimeout(time.Duration(o.StopTimeout) * time.Millisecond)
+	p.SetRestartPolicy(RestartPolicy{
+		Mode:       o.Restart,
+		MaxRetries: o.RestartRetries,
+		Backoff:    time.Duration(o.RestartBackoff) * time.Millisecond,
+		MaxBackoff: time.Duration(o.RestartMaxBackoff) * time.Millisecond,
+		ResetAfter: time.Duration(o.RestartReset) * time.Millisecond,
+	})
+	p.SetCrashLoop(o.CrashLoopCount, time.Duration(o.CrashLoopWindow)*time.Millisecond)
+}
+
 // NormalizeExt normalize comma-separated or space-separated extentions.
-// like ["go,md", "yml json"] into single ext valued array ["go", "md", "yml", "json"].
+// like ["go,md", "yml json"] into single ext valued array ["go", "json", "md", "yml"],
+// sorted so that equal sets of extensions compare equal.
 func NormalizeExt(ext []string) []string {
 	n := make(map[string]struct{})
 	seps := []string{",", " "}
@@ -65,6 +251,7 @@ func NormalizeExt(ext []string) []string {
 		}
 		keys = append(keys, k)
 	}
+	sort.Strings(keys)
 	return keys
 }
 
@@ -78,150 +265,247 @@ func (o *Option) IsTargetExt(ext string) bool {
 	return false
 }
 
+// IsTargetBasename detects the base name of path matches a basename pattern in option.
+func (o *Option) IsTargetBasename(path string) bool {
+	base := filepath.Base(path)
+	for _, v := range o.Basenames {
+		if ok, _ := filepath.Match(v, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// IsTargetEvent detects given event triggers a restart.
+// Without extensions in option every event does. Otherwise only events of
+// files with those extensions or matching basename patterns do, and renames
+// are checked by both the old and the new paths.
+func (o *Option) IsTargetEvent(ev FileEvent) bool {
+	if len(o.Ext) == 0 {
+		return true
+	}
+	if ev.IsDir {
+		return false
+	}
+	for _, path := range []string{ev.Path, ev.OldPath} {
+		if path == "" {
+			continue
+		}
+		if ext := filepath.Ext(path); ext != "" && o.IsTargetExt(ext) {
+			return true
+		}
+		if o.IsTargetBasename(path) {
+			return true
+		}
+	}
+	return false
+}
+
 // Goemon is file monitor.
 type Goemon struct {
-	watcher    *watcher.Watcher
-	watchStart time.Time
-	processes  []*Process
-	option     *Option
-	watches    []glob.Glob
-	ignores    []glob.Glob
+	mu        sync.Mutex
+	closed    bool
+	watcher   Watcher
+	watched   *watchIndex
+	debouncer *Debouncer
+	root      string
+	output    *Output
+	processes []*Process
+	runs      map[*Process]bool
+	names     map[string]*Process
+	rules     []*Rule
+	option    *Option
+	filter    *Filter
+	hasher    *Hasher
+	ops       Op
+	events    *eventHub
 }
 
 // New initializes Goemon watcher.
-func New(cmds []string, opt *Option) StartCloser {
+func New(cmds []string, opt *Option) *Goemon {
 	if opt == nil {
 		opt = &Option{}
 	}
 	opt.Default()
+	return newGoemon(cmds, opt, NewOutput(os.Stdout, os.Stderr, UseColor(opt.Color, os.Stdout)), 0)
+}
 
+// newGoemon initializes Goemon writing outputs of processes to output,
+// colored from the color index.
+func newGoemon(cmds []string, opt *Option, output *Output, color int) *Goemon {
 	opt.Ext = NormalizeExt(opt.Ext)
 
 	procs := make([]*Process, 0, len(cmds))
-	for _, v := range cmds {
-		p := NewProcess(v)
-		p.SetVerbose(opt.Verbose)
+	if opt.Sequential {
+		p := NewPipeline(cmds)
+		opt.configure(p)
 		procs = append(procs, p)
+	} else {
+		for _, v := range cmds {
+			p := NewProcess(v)
+			opt.configure(p)
+			procs = append(procs, p)
+		}
 	}
 
-	return &Goemon{
+	events := newEventHub()
+	names := make(map[string]*Process)
+	for i, p := range procs {
+		label := opt.label(i, len(procs))
+		p.SetOutput(output.Writers(label, color+i))
+		p.parent = events
+		if label != "" {
+			names[label] = p
+		}
+		names[strconv.Itoa(i)] = p
+	}
+
+	rules := make([]*Rule, 0, len(opt.Rules))
+	for _, v := range opt.Rules {
+		if r, err := ParseRule(v); err == nil {
+			rules = append(rules, r)
+		}
+	}
+
+	root, _ := os.Getwd()
+	g := &Goemon{
+		watcher:   newWatcher(opt.Backend),
+		watched:   newWatchIndex(),
+		root:      root,
+		output:    output,
 		processes: procs,
+		runs:      make(map[*Process]bool),
+		names:     names,
+		rules:     rules,
 		option:    opt,
-		watches:   CompileGlobs(opt.Watches),
-		ignores:   CompileGlobs(opt.Ignores),
+		events:    events,
+	}
+	g.filter = NewFilter(root, opt.Watches, opt.Ignores)
+	g.filter.SetGitIgnore(opt.GitIgnore)
+	g.ops, _ = ParseOps(opt.Ops)
+	if opt.Hash {
+		g.hasher = NewHasher(int64(opt.HashMaxSize))
 	}
+	g.debouncer = NewDebouncer(time.Duration(opt.Delay)*time.Millisecond, g.restart)
+	return g
 }
 
-func newWatcher() *watcher.Watcher {
-	w := watcher.New()
+// Processes returns the processes controlled by Goemon.
+func (g *Goemon) Processes() []*Process {
+	return g.processes
+}
+
+// Subscribe returns a channel which receives lifecycle events of all processes.
+// Events are dropped if the channel is not drained in time.
+func (g *Goemon) Subscribe() <-chan ProcessEvent {
+	return g.events.subscribe()
+}
 
-	w.SetMaxEvents(10)
-	w.IgnoreHiddenFiles(false)
+// Unsubscribe stops sending events to ch and closes it.
+func (g *Goemon) Unsubscribe(ch <-chan ProcessEvent) {
+	g.events.unsubscribe(ch)
+}
 
-	w.FilterOps(
-		watcher.Remove,
-		watcher.Write,
-		watcher.Rename,
-		watcher.Move,
-		watcher.Chmod,
-		watcher.Create,
-	)
+// newWatcher initializes Watcher of backend, falling back to the poller
+// if the backend is not available.
+func newWatcher(backend string) Watcher {
+	w, err := NewWatcher(backend)
+	if err != nil {
+		fmt.Printf("[goemon] %v, falling back to %v watcher\n", err, BackendPoll)
+		w, _ = NewWatcher(BackendPoll)
+	}
 	return w
 }
 
 // ListTarget lists files accouding to watches and ignores globbing pattern.
 func ListTarget(watches, ignores []glob.Glob) map[string]os.FileInfo {
-
-	targets := make(map[string]os.FileInfo)
-
-	wWalker := NewGlobWalker(watches)
-
-	wWalker.Walk(".", func(target string, fi os.FileInfo, e error) error {
-		targets[target] = fi
-		return nil
-	})
-
-	iWalker := NewGlobWalker(ignores)
-
-	iWalker.Walk(".", func(ignore string, fi os.FileInfo, e error) error {
-		if fi.IsDir() {
-			p := ignore + string(os.PathSeparator) + "**"
-			w := NewGlobWalker(CompileGlobs([]string{p}))
-			w.Walk(ignore, func(f string, cfi os.FileInfo, ce error) error {
-				delete(targets, f)
-				return nil
-			})
-
-		} else {
-			p := "**" + trimPathSeparator(ignore)
-			w := NewGlobWalker(CompileGlobs([]string{p}))
-			w.Walk(ignore, func(f string, cfi os.FileInfo, ce error) error {
-				delete(targets, f)
-				return nil
-			})
-		}
-
-		delete(targets, ignore)
-		return nil
-	})
-
-	return targets
-}
-
-func trimPathSeparator(s string) string {
-	sep := string(os.PathSeparator)
-	return strings.Trim(s, sep)
+	root, _ := os.Getwd()
+	rules := make([]filterRule, 0, len(watches)+len(ignores))
+	for _, g := range watches {
+		rules = append(rules, filterRule{g, true})
+	}
+	for _, g := range ignores {
+		rules = append(rules, filterRule{g, false})
+	}
+	return newFilter(root, rules).List()
 }
 
-// Start starts watching.
+// Start starts watching, and blocks until the watcher is closed.
+// It returns the error if the watcher failed.
 func (g *Goemon) Start() error {
+	if g.isClosed() {
+		return nil
+	}
 
-	g.watcher = newWatcher()
-
-	for k := range ListTarget(g.watches, g.ignores) {
-		g.watcher.Add(k)
+	targets, err := g.watchTree(".")
+	if _, poll := g.watcher.(*pollWatcher); err != nil && !poll {
+		fmt.Printf("[goemon] failed to watch: %v, falling back to %v watcher\n", err, BackendPoll)
+		if !g.setWatcher(NewPollWatcher(200 * time.Millisecond)) {
+			return nil
+		}
+		targets, err = g.watchTree(".")
+	}
+	if err != nil {
+		fmt.Printf("[goemon] failed to watch: %v\n", err)
+	}
+	if g.hasher != nil {
+		for path, fi := range targets {
+			if !fi.IsDir() {
+				g.hasher.Add(path)
+			}
+		}
 	}
 
 	for _, p := range g.processes {
+		if g.isClosed() {
+			return nil
+		}
 		err := p.Start()
+		if err == ErrClosed {
+			return nil
+		}
 		if err != nil {
 			fmt.Println(err)
+			continue
+		}
+		// Following commands may depend on this one.
+		if err := p.WaitReady(); err != nil {
+			fmt.Println(err)
 		}
 	}
 
+	failed := make(chan error, 1)
 	watch := func(g *Goemon) {
 		for {
 			select {
-			case event := <-g.watcher.Event:
-				if event.ModTime().Before(
-					g.watchStart.Add(time.Duration(g.option.Delay) * time.Millisecond),
-				) {
-					continue
-				}
-				if g.option.Verbose {
-					fmt.Println(event.ModTime(), event) // Print the event's info.
+			case event, ok := <-g.watcher.Events():
+				if !ok {
+					if g.option.Verbose {
+						fmt.Println("watcher closed.")
+					}
+					return
 				}
-				ext := filepath.Ext(event.Path)
-				if ext == "" || g.option.IsTargetExt(ext) {
-					for _, p := range g.processes {
-						if event.ModTime().Before(
-							p.Started().Add(time.Duration(g.option.Delay) * time.Millisecond),
-						) {
-							continue
-						}
-						err := p.Restart()
-						if err != nil {
-							fmt.Println(err)
-						}
+				for _, ev := range g.syncWatches(event) {
+					if !g.filter.IsTarget(ev.Path, ev.IsDir) && (ev.OldPath == "" || !g.filter.IsTarget(ev.OldPath, ev.IsDir)) {
+						continue
+					}
+					if g.option.Verbose {
+						fmt.Println(ev.ModTime, ev) // Print the event's info.
 					}
+					if ev.Op&g.ops == 0 || !g.option.IsTargetEvent(ev) {
+						continue
+					}
+					g.debouncer.Add(ev)
 				}
 
-			case err := <-g.watcher.Error:
-				log.Fatalln(err)
-			case <-g.watcher.Closed:
-				fmt.Println("watcher closed.")
+			case err := <-g.watcher.Errors():
+				if err == ErrOverflow {
+					g.rescan()
+					continue
+				}
+				failed <- fmt.Errorf("watcher failed: %v", err)
+				g.watcher.Close()
 				return
-			default:
 			}
 		}
 	}
@@ -231,18 +515,174 @@ func (g *Goemon) Start() error {
 	if g.option.PrintWatches {
 		g.PrintWatchedFiles()
 	}
-	g.watchStart = time.Now()
-	return g.watcher.Start(time.Millisecond * 200)
+	if err := g.watcher.Start(); err != nil {
+		return err
+	}
+
+	select {
+	case err := <-failed:
+		return err
+	default:
+		return nil
+	}
 }
 
-// Close stops watching.
-func (g *Goemon) Close() {
+// restart applies the rules to the change set cs.
+// Processes are all restarted by the changes which match no rule.
+func (g *Goemon) restart(cs ChangeSet) {
+	if g.isClosed() {
+		return
+	}
+	if g.hasher != nil {
+		if cs = g.contentChanged(cs); len(cs) == 0 {
+			return
+		}
+	}
+	if g.option.Verbose {
+		fmt.Printf("[goemon] %d file(s) changed\n", len(cs))
+	}
+
+	matches, rest := matchRules(g.rules, cs, g.filter.Rel)
+	for _, m := range matches {
+		if g.option.Verbose {
+			fmt.Printf("[goemon] rule %v\n", m.rule)
+		}
+		if err := g.apply(m.rule, m.changes); err != nil {
+			fmt.Printf("[goemon] rule %v: %v\n", m.rule, err)
+		}
+	}
+	if len(rest) == 0 {
+		return
+	}
+	for _, p := range g.processes {
+		if err := p.RestartWith(rest); err != nil && err != ErrClosed {
+			fmt.Println(err)
+		}
+	}
+}
+
+// contentChanged returns the changes of cs whose content changed.
+// Files are hashed once the changes are debounced, not on every event.
+func (g *Goemon) contentChanged(cs ChangeSet) ChangeSet {
+	changed := make(ChangeSet, 0, len(cs))
+	for _, ev := range cs {
+		if g.hasher.Changed(ev) {
+			changed = append(changed, ev)
+		} else if g.option.Verbose {
+			fmt.Printf("[goemon] skipped %v, content unchanged\n", ev)
+		}
+	}
+	return changed
+}
+
+// apply runs the actions of rule r in order, triggered by the change set cs.
+func (g *Goemon) apply(r *Rule, cs ChangeSet) error {
+	for _, a := range r.Actions {
+		if g.isClosed() {
+			return nil
+		}
+		switch a.Kind {
+		case ActionRestart:
+			p, ok := g.names[a.Target]
+			if !ok {
+				return fmt.Errorf("unknown command %q", a.Target)
+			}
+			if err := p.RestartWith(cs); err != nil {
+				return err
+			}
+		case ActionRun:
+			if err := g.run(a.Target, cs); err != nil {
+				return fmt.Errorf("%q failed: %v", a.Target, err)
+			}
+		}
+	}
+	return nil
+}
+
+// run runs command once with the process options, triggered by the change set cs,
+// and waits for it to exit.
+func (g *Goemon) run(command string, cs ChangeSet) error {
+	p := NewProcess(command)
+	g.option.configure(p)
+	p.changes = cs
+	p.SetOutput(g.output.Writers(ActionRun, len(g.processes)))
+
+	// Track it, so that Close stops it.
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil
+	}
+	g.runs[p] = true
+	g.mu.Unlock()
+	defer func() {
+		g.mu.Lock()
+		delete(g.runs, p)
+		g.mu.Unlock()
+	}()
+	return p.runStep(command)
+}
+
+// Run starts watching and blocks until ctx is done or the watcher failed.
+// All processes are stopped before Run returns.
+func (g *Goemon) Run(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- g.Start()
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-done:
+	}
+
+	g.Close()
+	return err
+}
+
+// setWatcher replaces the watcher with w, closing the old one.
+// It reports false if Goemon is closed.
+func (g *Goemon) setWatcher(w Watcher) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.closed {
+		w.Close()
+		return false
+	}
 	g.watcher.Close()
+	g.watcher = w
+	g.watched = newWatchIndex()
+	return true
+}
+
+// Close stops watching and all processes, including the ones run by rules.
+func (g *Goemon) Close() {
+	g.mu.Lock()
+	g.closed = true
+	w := g.watcher
+	runs := make([]*Process, 0, len(g.runs))
+	for p := range g.runs {
+		runs = append(runs, p)
+	}
+	g.mu.Unlock()
+
+	w.Close()
+	g.debouncer.Stop()
+	for _, p := range runs {
+		p.Close()
+	}
 	for _, p := range g.processes {
-		p.Stop()
+		p.Close()
 	}
 }
 
+func (g *Goemon) isClosed() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.closed
+}
+
 // PrintWatchedFiles prints
 func (g *Goemon) PrintWatchedFiles() {
 	files := g.listWatchedFiles()
@@ -250,9 +690,14 @@ func (g *Goemon) PrintWatchedFiles() {
 }
 
 func (g *Goemon) listWatchedFiles() []string {
-	files := make([]string, 0, len(g.watcher.WatchedFiles()))
+	watched := g.watcher.WatchedFiles()
+	files := make([]string, 0, len(watched))
 	cwd, _ := os.Getwd()
-	for k := range g.watcher.WatchedFiles() {
+	for _, k := range watched {
+		fi, err := os.Stat(k)
+		if err != nil || !g.filter.IsTarget(k, fi.IsDir()) {
+			continue
+		}
 		f, _ := filepath.Rel(cwd, k)
 		files = append(files, f)
 	}
@@ -1,8 +1,13 @@
 package goemon_test
 
 import (
+	"context"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/gcoka/goemon/goemon"
 )
@@ -54,13 +59,375 @@ func TestNormalizeExt(t *testing.T) {
 		want []string
 	}{
 		// TODO: Add test cases.
-		{"1", args{[]string{"go,md", "yml json"}}, []string{"go", "md", "yml", "json"}},
+		{"1", args{[]string{"go,md", "yml json"}}, []string{"go", "json", "md", "yml"}},
+		{"duplicated", args{[]string{"ts,go", "go"}}, []string{"go", "ts"}},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			if got := goemon.NormalizeExt(tt.args.ext); !deepEqualSorted(got, tt.want) {
+			if got := goemon.NormalizeExt(tt.args.ext); !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("NormalizeExt() = %v, want %v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestOption_IsTargetEvent(t *testing.T) {
+	ops := []goemon.Op{goemon.Create, goemon.Write, goemon.Remove, goemon.Rename, goemon.Move, goemon.Chmod}
+	tests := []struct {
+		name      string
+		ext       []string
+		basenames []string
+		ev        goemon.FileEvent
+		want      bool
+	}{
+		{"no ext, file", nil, nil, goemon.FileEvent{Path: "/a/main.go"}, true},
+		{"no ext, extensionless", nil, nil, goemon.FileEvent{Path: "/a/Makefile"}, true},
+		{"no ext, directory", nil, nil, goemon.FileEvent{Path: "/a/pkg", IsDir: true}, true},
+		{"ext, matched", []string{"go"}, nil, goemon.FileEvent{Path: "/a/main.go"}, true},
+		{"ext with dot, matched", []string{".go"}, nil, goemon.FileEvent{Path: "/a/main.go"}, true},
+		{"ext, unmatched", []string{"go"}, nil, goemon.FileEvent{Path: "/a/README.md"}, false},
+		{"ext, extensionless", []string{"go"}, nil, goemon.FileEvent{Path: "/a/Makefile"}, false},
+		{"ext, directory", []string{"go"}, nil, goemon.FileEvent{Path: "/a/pkg.go", IsDir: true}, false},
+		{"basename", []string{"go"}, []string{"Makefile"}, goemon.FileEvent{Path: "/a/Makefile"}, true},
+		{"basename pattern", []string{"go"}, []string{"Dockerfile*"}, goemon.FileEvent{Path: "/a/Dockerfile.dev"}, true},
+		{"basename, unmatched", []string{"go"}, []string{"Makefile"}, goemon.FileEvent{Path: "/a/Dockerfile"}, false},
+		{"old path", []string{"go"}, nil, goemon.FileEvent{Path: "/a/main.go.bak", OldPath: "/a/main.go"}, true},
+	}
+	for _, tt := range tests {
+		for _, op := range ops {
+			t.Run(tt.name+" "+op.String(), func(t *testing.T) {
+				opt := &goemon.Option{Ext: tt.ext, Basenames: tt.basenames}
+				opt.Default()
+				ev := tt.ev
+				ev.Op = op
+				if got := opt.IsTargetEvent(ev); got != tt.want {
+					t.Errorf("Option.IsTargetEvent(%v) = %v, want %v", ev, got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestGoemon_Run(t *testing.T) {
+	tmpDir := setup(t)
+	defer os.RemoveAll(tmpDir)
+
+	cDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cDir)
+
+	g := goemon.New([]string{"sleep 10"}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		done <- g.Run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Goemon.Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Goemon.Run() did not return after the context is done")
+	}
+	for _, p := range g.Processes() {
+		if !p.Exited() {
+			t.Errorf("%v is running after Run returned", p)
+		}
+	}
+}
+
+// waitRestart waits for a restart of p, and returns the change set which triggered it.
+func waitRestart(p *goemon.Process, events <-chan goemon.ProcessEvent, timeout time.Duration) (goemon.ChangeSet, bool) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case ev := <-events:
+			if ev.Process == p && ev.Type == goemon.ProcessRestarting {
+				return p.Changes(), true
+			}
+		case <-deadline:
+			return nil, false
+		}
+	}
+}
+
+func TestGoemon_WatchCreated(t *testing.T) {
+	for _, backend := range []string{goemon.BackendNative, goemon.BackendPoll} {
+		t.Run(backend, func(t *testing.T) {
+			tmpDir := setup(t)
+			defer os.RemoveAll(tmpDir)
+			tmpDir, _ = filepath.EvalSymlinks(tmpDir)
+
+			cDir, err := os.Getwd()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chdir(tmpDir); err != nil {
+				t.Fatal(err)
+			}
+			defer os.Chdir(cDir)
+
+			g := goemon.New([]string{"sleep 10"}, &goemon.Option{
+				Delay:   100,
+				Ext:     []string{"go"},
+				Watches: []string{"*.go"},
+				Ignores: []string{"vendor"},
+				Backend: backend,
+			})
+			p := g.Processes()[0]
+			p.SetOutput(nopWriter{}, nopWriter{})
+			events := g.Subscribe()
+			defer g.Close()
+			go g.Start()
+			time.Sleep(300 * time.Millisecond)
+
+			tests := []struct {
+				name string
+				do   func() error
+				want []string
+			}{
+				{"new directory with file", func() error {
+					os.MkdirAll("pkg/sub", 0755)
+					return ioutil.WriteFile("pkg/sub/a.go", []byte{}, 0644)
+				}, []string{"pkg/sub/a.go"}},
+				{"new file in new directory", func() error {
+					return ioutil.WriteFile("pkg/sub/b.go", []byte{}, 0644)
+				}, []string{"pkg/sub/b.go"}},
+				{"new file not matching", func() error {
+					return ioutil.WriteFile("pkg/sub/c.txt", []byte{}, 0644)
+				}, nil},
+				{"new file in ignored directory", func() error {
+					os.MkdirAll("vendor/new", 0755)
+					return ioutil.WriteFile("vendor/new/d.go", []byte{}, 0644)
+				}, nil},
+				{"removed directory", func() error {
+					return os.RemoveAll("pkg")
+				}, []string{"pkg/sub/a.go", "pkg/sub/b.go"}},
+				{"recreated directory", func() error {
+					os.MkdirAll("pkg/sub", 0755)
+					time.Sleep(300 * time.Millisecond)
+					return ioutil.WriteFile("pkg/sub/e.go", []byte{}, 0644)
+				}, []string{"pkg/sub/e.go"}},
+			}
+			for _, tt := range tests {
+				if err := tt.do(); err != nil {
+					t.Fatal(err)
+				}
+				timeout := 2 * time.Second
+				if tt.want == nil {
+					timeout = 500 * time.Millisecond
+				}
+				cs, restarted := waitRestart(p, events, timeout)
+				if restarted != (tt.want != nil) {
+					t.Errorf("%v: restarted = %v, want %v", tt.name, restarted, tt.want != nil)
+					continue
+				}
+				got := make([]string, 0)
+				for _, f := range cs.Files() {
+					if rel, _ := filepath.Rel(tmpDir, f); filepath.Ext(rel) == ".go" {
+						got = append(got, rel)
+					}
+				}
+				if restarted && !deepEqualSorted(got, tt.want) {
+					t.Errorf("%v: changed files = %v, want %v", tt.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGoemon_Rules(t *testing.T) {
+	tmpDir := setup(t)
+	defer os.RemoveAll(tmpDir)
+	tmpDir, _ = filepath.EvalSymlinks(tmpDir)
+
+	cDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cDir)
+	os.MkdirAll("web", 0755)
+	os.MkdirAll("migrations", 0755)
+
+	g := goemon.New([]string{"sleep 10", "sleep 10"}, &goemon.Option{
+		Delay: 100,
+		Ext:   []string{"go", "scss", "md", "sql"},
+		Ops:   []string{"!chmod"},
+		Names: []string{"api", "worker"},
+		Rules: []string{
+			"*.go -> restart api",
+			`web/*.scss -> run "echo css >> css.log" then restart worker`,
+			"migrations/* on create,remove -> restart worker",
+		},
+	})
+	api, worker := g.Processes()[0], g.Processes()[1]
+	for _, p := range g.Processes() {
+		p.SetOutput(nopWriter{}, nopWriter{})
+	}
+	events := g.Subscribe()
+	defer g.Close()
+	go g.Start()
+	time.Sleep(300 * time.Millisecond)
+
+	write := func(file string) func() error {
+		return func() error { return ioutil.WriteFile(file, []byte(file), 0644) }
+	}
+	tests := []struct {
+		name    string
+		do      func() error
+		want    []*goemon.Process
+		wantRun bool
+	}{
+		{"go", write("main.go"), []*goemon.Process{api}, false},
+		{"scss", write("web/app.scss"), []*goemon.Process{worker}, true},
+		{"no rule", write("README.md"), []*goemon.Process{api, worker}, false},
+		{"chmod", func() error { return os.Chmod("main.go", 0600) }, []*goemon.Process{}, false},
+		{"rule op", write("migrations/1.sql"), []*goemon.Process{worker}, false},
+		{"other rule op", write("migrations/1.sql"), []*goemon.Process{}, false},
+	}
+	for _, tt := range tests {
+		os.Remove("css.log")
+		if err := tt.do(); err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]*goemon.Process, 0)
+		timeout := time.After(time.Second)
+	wait:
+		for {
+			select {
+			case ev := <-events:
+				if ev.Type == goemon.ProcessRestarting {
+					got = append(got, ev.Process)
+				}
+			case <-timeout:
+				break wait
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%v: restarted %v, want %v", tt.name, got, tt.want)
+		}
+		for i := range got {
+			if i < len(tt.want) && got[i] != tt.want[i] {
+				t.Errorf("%v: restarted %v, want %v", tt.name, got, tt.want)
+			}
+		}
+		if _, err := os.Stat("css.log"); (err == nil) != tt.wantRun {
+			t.Errorf("%v: run = %v, want %v", tt.name, err == nil, tt.wantRun)
+		}
+	}
+}
+
+func TestGoemon_CloseStopsRuns(t *testing.T) {
+	tmpDir := setup(t)
+	defer os.RemoveAll(tmpDir)
+
+	cDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cDir)
+
+	g := goemon.New([]string{"sleep 10"}, &goemon.Option{
+		Delay: 100,
+		Rules: []string{`*.go -> run "echo started > run.log; sleep 1; echo finished >> run.log"`},
+	})
+	g.Processes()[0].SetOutput(nopWriter{}, nopWriter{})
+	go g.Start()
+	time.Sleep(300 * time.Millisecond)
+
+	if err := ioutil.WriteFile("main.go", []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if b, _ := ioutil.ReadFile("run.log"); string(b) == "started\n" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("rule did not run")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		g.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Goemon.Close() did not return")
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if b, _ := ioutil.ReadFile("run.log"); string(b) != "started\n" {
+		t.Errorf("run.log = %q, want the rule stopped by Close", b)
+	}
+}
+
+func TestGoemon_Hash(t *testing.T) {
+	tmpDir := setup(t)
+	defer os.RemoveAll(tmpDir)
+
+	cDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cDir)
+	if err := ioutil.WriteFile("main.go", []byte("package main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	g := goemon.New([]string{"sleep 10"}, &goemon.Option{
+		Delay: 100,
+		Ext:   []string{"go"},
+		Hash:  true,
+	})
+	p := g.Processes()[0]
+	p.SetOutput(nopWriter{}, nopWriter{})
+	events := g.Subscribe()
+	defer g.Close()
+	go g.Start()
+	time.Sleep(300 * time.Millisecond)
+
+	tests := []struct {
+		name     string
+		contents []string
+		want     bool
+	}{
+		{"same content", []string{"package main"}, false},
+		{"changed", []string{"package main\n"}, true},
+		{"changed back within delay", []string{"package x", "package main\n"}, false},
+	}
+	for _, tt := range tests {
+		for _, c := range tt.contents {
+			if err := ioutil.WriteFile("main.go", []byte(c), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, restarted := waitRestart(p, events, time.Second); restarted != tt.want {
+			t.Errorf("%v: restarted = %v, want %v", tt.name, restarted, tt.want)
+		}
+	}
+}
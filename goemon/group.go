@@ -0,0 +1,215 @@
+package goemon
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// Task is a named set of commands watching files by its own options.
+type Task struct {
+	Name     string
+	Commands []string
+	Option   *Option
+}
+
+// Validate checks the task can be run.
+func (t *Task) Validate() error {
+	if len(t.Commands) == 0 {
+		return fmt.Errorf("task %q has no commands", t.Name)
+	}
+	opt := *t.Option
+	opt.Names = t.names()
+	if err := opt.Validate(); err != nil {
+		if t.Name == "" {
+			return err
+		}
+		return fmt.Errorf("task %q: %v", t.Name, err)
+	}
+	return nil
+}
+
+// names returns the output labels of the commands. Unnamed commands are
+// labeled by the task name, and their index if the task has many of them.
+func (t *Task) names() []string {
+	n := len(t.Commands)
+	if t.Option.Sequential {
+		n = 1
+	}
+	names := make([]string, n)
+	for i := range names {
+		switch {
+		case i < len(t.Option.Names) && t.Option.Names[i] != "":
+			names[i] = t.Option.Names[i]
+		case t.Name == "":
+		case n == 1:
+			names[i] = t.Name
+		default:
+			names[i] = t.Name + "." + strconv.Itoa(i)
+		}
+	}
+	return names
+}
+
+// Group supervises tasks, each by its own Goemon.
+// Tasks can be changed while running by Apply.
+type Group struct {
+	mu      sync.Mutex
+	members []*member
+	output  *Output
+	color   int
+	ctx     context.Context
+	errs    chan error
+}
+
+// member is a task and the Goemon running it.
+type member struct {
+	task   *Task
+	goemon *Goemon
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewGroup initializes Group of tasks. Outputs of all the commands are
+// multiplexed, colorized by the color mode of the first task.
+func NewGroup(tasks []*Task) *Group {
+	gr := &Group{}
+	for _, t := range tasks {
+		t.prepare()
+		gr.members = append(gr.members, gr.newMember(t))
+	}
+	return gr
+}
+
+// prepare completes the option of the task, so that tasks of the same
+// definition are deeply equal.
+func (t *Task) prepare() {
+	if t.Option == nil {
+		t.Option = &Option{}
+	}
+	t.Option.Default()
+	t.Option.Names = t.names()
+	t.Option.Ext = NormalizeExt(t.Option.Ext)
+}
+
+// newMember initializes Goemon of the prepared task.
+func (gr *Group) newMember(t *Task) *member {
+	if gr.output == nil {
+		gr.output = NewOutput(os.Stdout, os.Stderr, UseColor(t.Option.Color, os.Stdout))
+	}
+	g := newGoemon(t.Commands, t.Option, gr.output, gr.color)
+	gr.color += len(g.processes)
+	return &member{task: t, goemon: g}
+}
+
+// Goemon returns the Goemon of the named task, or nil if there is no such task.
+func (gr *Group) Goemon(name string) *Goemon {
+	gr.mu.Lock()
+	defer gr.mu.Unlock()
+	for _, m := range gr.members {
+		if m.task.Name == name {
+			return m.goemon
+		}
+	}
+	return nil
+}
+
+// Run runs all the tasks until ctx is done or any of them fails.
+// It returns the first error of the tasks.
+func (gr *Group) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	gr.mu.Lock()
+	gr.ctx = ctx
+	gr.errs = make(chan error, 1)
+	for _, m := range gr.members {
+		gr.start(m)
+	}
+	errs := gr.errs
+	gr.mu.Unlock()
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errs:
+	}
+	cancel()
+
+	gr.mu.Lock()
+	gr.ctx = nil
+	members := gr.members
+	gr.mu.Unlock()
+	for _, m := range members {
+		<-m.done
+	}
+	return err
+}
+
+// start runs the Goemon of m. gr.mu must be held.
+func (gr *Group) start(m *member) {
+	ctx, cancel := context.WithCancel(gr.ctx)
+	m.cancel, m.done = cancel, make(chan struct{})
+	go func() {
+		defer close(m.done)
+		if err := m.goemon.Run(ctx); err != nil {
+			select {
+			case gr.errs <- fmt.Errorf("task %q: %v", m.task.Name, err):
+			default:
+			}
+		}
+	}()
+}
+
+// stop stops the Goemon of m and waits for it. gr.mu must be held.
+func (gr *Group) stop(m *member) {
+	if m.cancel == nil {
+		m.goemon.Close()
+		return
+	}
+	m.cancel()
+	<-m.done
+}
+
+// Apply replaces the tasks. Tasks of the same name and definition are left
+// running, and the others are stopped, started or restarted as needed.
+func (gr *Group) Apply(tasks []*Task) {
+	gr.mu.Lock()
+	defer gr.mu.Unlock()
+
+	old := make(map[string]*member)
+	for _, m := range gr.members {
+		old[m.task.Name] = m
+	}
+	members := make([]*member, 0, len(tasks))
+	for _, t := range tasks {
+		t.prepare()
+		prev, ok := old[t.Name]
+		delete(old, t.Name)
+		switch {
+		case ok && reflect.DeepEqual(prev.task, t):
+			members = append(members, prev)
+			continue
+		case ok:
+			fmt.Printf("[goemon] task %q changed, restarting\n", t.Name)
+			gr.stop(prev)
+		default:
+			fmt.Printf("[goemon] task %q added\n", t.Name)
+		}
+		m := gr.newMember(t)
+		if gr.ctx != nil {
+			gr.start(m)
+		}
+		members = append(members, m)
+	}
+	for _, m := range gr.members {
+		if _, ok := old[m.task.Name]; ok {
+			fmt.Printf("[goemon] task %q removed\n", m.task.Name)
+			gr.stop(m)
+		}
+	}
+	gr.members = members
+}
@@ -0,0 +1,186 @@
+package goemon_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+func TestTask_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		task    *goemon.Task
+		wantErr bool
+	}{
+		{"valid", &goemon.Task{Name: "api", Commands: []string{"sleep 10"}, Option: &goemon.Option{}}, false},
+		{"rule by task name", &goemon.Task{Name: "api", Commands: []string{"sleep 10"},
+			Option: &goemon.Option{Rules: []string{"*.go -> restart api"}}}, false},
+		{"rule by label", &goemon.Task{Name: "api", Commands: []string{"sleep 10", "sleep 10"},
+			Option: &goemon.Option{Rules: []string{"*.go -> restart api.1"}}}, false},
+		{"rule by index", &goemon.Task{Name: "api", Commands: []string{"sleep 10", "sleep 10"},
+			Option: &goemon.Option{Rules: []string{"*.go -> restart 1"}}}, false},
+		{"rule by index out of range", &goemon.Task{Name: "api", Commands: []string{"sleep 10", "sleep 10"},
+			Option: &goemon.Option{Rules: []string{"*.go -> restart 2"}}}, true},
+		{"rule by index of sequential commands", &goemon.Task{Name: "api", Commands: []string{"make", "sleep 10"},
+			Option: &goemon.Option{Sequential: true, Rules: []string{"*.go -> restart 1"}}}, true},
+		{"no commands", &goemon.Task{Name: "api", Option: &goemon.Option{}}, true},
+		{"invalid option", &goemon.Task{Name: "api", Commands: []string{"sleep 10"},
+			Option: &goemon.Option{Restart: "sometimes"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.task.Option.Default()
+			if err := tt.task.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Task.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGroup_Run(t *testing.T) {
+	tmpDir := setup(t)
+	defer os.RemoveAll(tmpDir)
+
+	cDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cDir)
+
+	gr := goemon.NewGroup([]*goemon.Task{
+		{Name: "api", Commands: []string{"sleep 10"}, Option: &goemon.Option{Delay: 100, Watches: []string{"cmd"}}},
+		{Name: "worker", Commands: []string{"sleep 10", "sleep 10"}, Option: &goemon.Option{Delay: 100, Watches: []string{"hello"}}},
+	})
+	api, worker := gr.Goemon("api"), gr.Goemon("worker")
+	if api == nil || worker == nil || gr.Goemon("assets") != nil {
+		t.Fatal("Group.Goemon() must return the Goemon of each task")
+	}
+	if len(worker.Processes()) != 2 {
+		t.Fatalf("worker has %d processes, want 2", len(worker.Processes()))
+	}
+	for _, g := range []*goemon.Goemon{api, worker} {
+		for _, p := range g.Processes() {
+			p.SetOutput(nopWriter{}, nopWriter{})
+		}
+	}
+	apiEvents, workerEvents := api.Subscribe(), worker.Subscribe()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- gr.Run(ctx)
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	if err := ioutil.WriteFile(filepath.Join("hello", "hello.go"), []byte("package hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := waitRestart(worker.Processes()[0], workerEvents, 2*time.Second); !ok {
+		t.Error("worker is not restarted by a change of its watches")
+	}
+	if _, ok := waitRestart(api.Processes()[0], apiEvents, 500*time.Millisecond); ok {
+		t.Error("api is restarted by a change of the worker watches")
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Group.Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Group.Run() did not return after the context is done")
+	}
+	for _, g := range []*goemon.Goemon{api, worker} {
+		for _, p := range g.Processes() {
+			if !p.Exited() {
+				t.Errorf("%v is running after Run returned", p)
+			}
+		}
+	}
+}
+
+func TestGroup_Apply(t *testing.T) {
+	tmpDir := setup(t)
+	defer os.RemoveAll(tmpDir)
+
+	cDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cDir)
+
+	tasks := func(worker string) []*goemon.Task {
+		return []*goemon.Task{
+			{Name: "api", Commands: []string{"sleep 10"}, Option: &goemon.Option{StopTimeout: 100, Ext: []string{"go,md", "yml json", "ts", "scss"}}},
+			{Name: worker, Commands: []string{"sleep 10"}, Option: &goemon.Option{StopTimeout: 100}},
+		}
+	}
+	gr := goemon.NewGroup(tasks("worker"))
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- gr.Run(ctx)
+	}()
+	time.Sleep(300 * time.Millisecond)
+
+	api, worker := gr.Goemon("api"), gr.Goemon("worker")
+	gr.Apply(tasks("worker"))
+	if gr.Goemon("api") != api || gr.Goemon("worker") != worker {
+		t.Error("Group.Apply() replaced unchanged tasks")
+	}
+
+	changed := tasks("worker")
+	changed[1].Commands = []string{"sleep 20"}
+	gr.Apply(changed)
+	if gr.Goemon("api") != api {
+		t.Error("Group.Apply() replaced an unchanged task")
+	}
+	if gr.Goemon("worker") == worker {
+		t.Error("Group.Apply() did not replace a changed task")
+	}
+	if !worker.Processes()[0].Exited() {
+		t.Error("the process of the changed task is running")
+	}
+
+	removed := gr.Goemon("worker")
+	gr.Apply(tasks("assets"))
+	if gr.Goemon("worker") != nil || gr.Goemon("assets") == nil {
+		t.Fatal("Group.Apply() did not remove and add tasks")
+	}
+	if !removed.Processes()[0].Exited() {
+		t.Error("the process of the removed task is running")
+	}
+	time.Sleep(300 * time.Millisecond)
+	for _, name := range []string{"api", "assets"} {
+		if gr.Goemon(name).Processes()[0].Exited() {
+			t.Errorf("the process of %v is not running", name)
+		}
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Group.Run() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Group.Run() did not return after the context is done")
+	}
+	for _, name := range []string{"api", "assets"} {
+		if !gr.Goemon(name).Processes()[0].Exited() {
+			t.Errorf("the process of %v is running after Run returned", name)
+		}
+	}
+}
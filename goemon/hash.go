@@ -0,0 +1,87 @@
+package goemon
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Hasher remembers the content hashes of files, to tell whether an event
+// actually changed the content of a file, or was a no-op write, a touch or a chmod.
+type Hasher struct {
+	mu      sync.Mutex
+	maxSize int64
+	sums    map[string][sha256.Size]byte
+}
+
+// NewHasher initializes Hasher which hashes files up to maxSize bytes.
+func NewHasher(maxSize int64) *Hasher {
+	return &Hasher{maxSize: maxSize, sums: make(map[string][sha256.Size]byte)}
+}
+
+// sum returns the content hash of the regular file, and false if the file
+// can not be read or is larger than the size limit.
+func (h *Hasher) sum(path string) ([sha256.Size]byte, bool) {
+	var sum [sha256.Size]byte
+	f, err := os.Open(path)
+	if err != nil {
+		return sum, false
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil || !fi.Mode().IsRegular() || fi.Size() > h.maxSize {
+		return sum, false
+	}
+	hash := sha256.New()
+	if _, err := io.Copy(hash, io.LimitReader(f, h.maxSize+1)); err != nil {
+		return sum, false
+	}
+	copy(sum[:], hash.Sum(nil))
+	return sum, true
+}
+
+// Add records the content hash of the file.
+func (h *Hasher) Add(path string) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return
+	}
+	sum, ok := h.sum(abs)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ok {
+		h.sums[abs] = sum
+	} else {
+		delete(h.sums, abs)
+	}
+}
+
+// Changed reports whether ev changed the content of the file, and records its new hash.
+// Events of directories, of files removed or renamed away, of files larger than
+// the size limit and of files not recorded before are always changes.
+func (h *Hasher) Changed(ev FileEvent) bool {
+	if ev.IsDir {
+		return true
+	}
+	sum, ok := h.sum(ev.Path)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changed := false
+	if ev.OldPath != "" && ev.OldPath != ev.Path {
+		if _, recorded := h.sums[ev.OldPath]; recorded {
+			delete(h.sums, ev.OldPath)
+			changed = true
+		}
+	}
+	if !ok {
+		delete(h.sums, ev.Path)
+		return true
+	}
+	prev, recorded := h.sums[ev.Path]
+	h.sums[ev.Path] = sum
+	return changed || !recorded || prev != sum
+}
@@ -0,0 +1,63 @@
+package goemon_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+func TestHasher_Changed(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "goemon_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	writeFiles(t, tmpDir, map[string]string{"a.go": "package a", "big.go": "package big // larger than the limit"})
+
+	a, b := filepath.Join(tmpDir, "a.go"), filepath.Join(tmpDir, "b.go")
+	h := goemon.NewHasher(16)
+	h.Add(a)
+	h.Add(filepath.Join(tmpDir, "big.go"))
+
+	tests := []struct {
+		name   string
+		change func()
+		ev     goemon.FileEvent
+		want   bool
+	}{
+		{"same content", func() { writeFiles(t, tmpDir, map[string]string{"a.go": "package a"}) },
+			goemon.FileEvent{Op: goemon.Write, Path: a}, false},
+		{"touch", func() { os.Chtimes(a, time.Now(), time.Now().Add(time.Hour)) },
+			goemon.FileEvent{Op: goemon.Write, Path: a}, false},
+		{"chmod", func() { os.Chmod(a, 0600) },
+			goemon.FileEvent{Op: goemon.Chmod, Path: a}, false},
+		{"new content", func() { writeFiles(t, tmpDir, map[string]string{"a.go": "package b"}) },
+			goemon.FileEvent{Op: goemon.Write, Path: a}, true},
+		{"new content again", func() {},
+			goemon.FileEvent{Op: goemon.Write, Path: a}, false},
+		{"too large", func() {},
+			goemon.FileEvent{Op: goemon.Write, Path: filepath.Join(tmpDir, "big.go")}, true},
+		{"not recorded", func() { writeFiles(t, tmpDir, map[string]string{"b.go": "package b"}) },
+			goemon.FileEvent{Op: goemon.Create, Path: b}, true},
+		{"renamed away", func() { os.Rename(b, b+".bak") },
+			goemon.FileEvent{Op: goemon.Rename, Path: b + ".bak", OldPath: b}, true},
+		{"removed", func() { os.Remove(a) },
+			goemon.FileEvent{Op: goemon.Remove, Path: a}, true},
+		{"created with old content", func() { writeFiles(t, tmpDir, map[string]string{"a.go": "package b"}) },
+			goemon.FileEvent{Op: goemon.Create, Path: a}, true},
+		{"directory", func() {},
+			goemon.FileEvent{Op: goemon.Chmod, Path: tmpDir, IsDir: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change()
+			if got := h.Changed(tt.ev); got != tt.want {
+				t.Errorf("Hasher.Changed(%v) = %v, want %v", tt.ev, got, tt.want)
+			}
+		})
+	}
+}
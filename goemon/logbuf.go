@@ -0,0 +1,89 @@
+package goemon
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLine is a line of command output.
+type LogLine struct {
+	Time   time.Time
+	Stderr bool
+	Text   string
+}
+
+// LogBuffer is a ring buffer which keeps the most recent lines of command output.
+type LogBuffer struct {
+	mu    sync.Mutex
+	lines []LogLine
+	next  int
+	full  bool
+}
+
+// NewLogBuffer initializes LogBuffer holding up to size lines.
+func NewLogBuffer(size int) *LogBuffer {
+	if size < 1 {
+		size = 1
+	}
+	return &LogBuffer{lines: make([]LogLine, size)}
+}
+
+// Add appends a line, overwriting the oldest one when the buffer is full.
+func (b *LogBuffer) Add(line LogLine) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lines[b.next] = line
+	b.next++
+	if b.next == len(b.lines) {
+		b.next = 0
+		b.full = true
+	}
+}
+
+// Last returns the last n lines in order. n <= 0 returns all lines.
+func (b *LogBuffer) Last(n int) []LogLine {
+	all := b.all()
+	if n > 0 && n < len(all) {
+		return all[len(all)-n:]
+	}
+	return all
+}
+
+// Since returns the lines written at or after t in order.
+func (b *LogBuffer) Since(t time.Time) []LogLine {
+	all := b.all()
+	for i, l := range all {
+		if !l.Time.Before(t) {
+			return all[i:]
+		}
+	}
+	return []LogLine{}
+}
+
+// all returns a copy of buffered lines in order.
+func (b *LogBuffer) all() []LogLine {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.full {
+		return append([]LogLine{}, b.lines[:b.next]...)
+	}
+	all := make([]LogLine, 0, len(b.lines))
+	all = append(all, b.lines[b.next:]...)
+	return append(all, b.lines[:b.next]...)
+}
+
+// logWriter adds each written line to LogBuffer.
+type logWriter struct {
+	b      *LogBuffer
+	stderr bool
+}
+
+func (w *logWriter) Write(line []byte) (int, error) {
+	w.b.Add(LogLine{
+		Time:   time.Now(),
+		Stderr: w.stderr,
+		Text:   strings.TrimRight(string(line), "\r\n"),
+	})
+	return len(line), nil
+}
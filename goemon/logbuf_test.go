@@ -0,0 +1,68 @@
+package goemon_test
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+func logTexts(lines []goemon.LogLine) []string {
+	texts := make([]string, 0, len(lines))
+	for _, l := range lines {
+		texts = append(texts, l.Text)
+	}
+	return texts
+}
+
+func TestLogBuffer(t *testing.T) {
+	base := time.Now()
+	b := goemon.NewLogBuffer(3)
+	for i, text := range []string{"a", "b", "c", "d", "e"} {
+		b.Add(goemon.LogLine{Time: base.Add(time.Duration(i) * time.Second), Text: text})
+	}
+
+	tests := []struct {
+		name string
+		got  []goemon.LogLine
+		want []string
+	}{
+		{"all", b.Last(0), []string{"c", "d", "e"}},
+		{"last 2", b.Last(2), []string{"d", "e"}},
+		{"more than kept", b.Last(10), []string{"c", "d", "e"}},
+		{"since", b.Since(base.Add(3 * time.Second)), []string{"d", "e"}},
+		{"since future", b.Since(base.Add(time.Hour)), []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := logTexts(tt.got); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LogBuffer lines = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcess_Logs(t *testing.T) {
+	p := goemon.NewProcess(`echo 1; echo 2 >&2; echo 3`)
+	p.SetOutput(nopWriter{}, nopWriter{})
+	p.SetLogSize(2)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	p.Wait()
+
+	got := p.Logs(0)
+	if len(got) != 2 {
+		t.Fatalf("Process.Logs() = %v, want 2 lines", got)
+	}
+	for _, l := range got {
+		if l.Stderr != (l.Text == "2") {
+			t.Errorf("Process.Logs() line %q Stderr = %v", l.Text, l.Stderr)
+		}
+	}
+}
+
+type nopWriter struct{}
+
+func (nopWriter) Write(b []byte) (int, error) { return len(b), nil }
@@ -0,0 +1,116 @@
+package goemon
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Color modes.
+const (
+	ColorAuto   = "auto"
+	ColorAlways = "always"
+	ColorNever  = "never"
+)
+
+var palette = []int{36, 33, 32, 35, 34, 96, 93, 92, 95, 94}
+
+// Output multiplexes line by line outputs of processes into shared writers.
+type Output struct {
+	mu     sync.Mutex
+	stdout io.Writer
+	stderr io.Writer
+	color  bool
+}
+
+// NewOutput initializes Output.
+func NewOutput(stdout, stderr io.Writer, color bool) *Output {
+	return &Output{
+		stdout: stdout,
+		stderr: stderr,
+		color:  color,
+	}
+}
+
+// UseColor decides whether to colorize output written to f by color mode.
+func UseColor(mode string, f *os.File) bool {
+	switch mode {
+	case ColorAlways:
+		return true
+	case ColorNever:
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// ValidateColorMode checks mode is one of the color modes.
+func ValidateColorMode(mode string) error {
+	switch mode {
+	case ColorAuto, ColorAlways, ColorNever:
+		return nil
+	}
+	return fmt.Errorf("unknown color mode %q, must be one of %v, %v or %v",
+		mode, ColorAuto, ColorAlways, ColorNever)
+}
+
+// Writers returns stdout and stderr writers which prefix each line with label.
+// index selects the label color, so the same index always gets the same color.
+// Lines written to stderr are marked with "!".
+// Empty label writes lines as they are.
+func (o *Output) Writers(label string, index int) (stdout, stderr io.Writer) {
+	if label == "" {
+		return &labelWriter{o, o.stdout, ""}, &labelWriter{o, o.stderr, ""}
+	}
+
+	prefix := "[" + label + "]"
+	if o.color {
+		prefix = fmt.Sprintf("\x1b[%dm%s\x1b[0m", palette[index%len(palette)], prefix)
+	}
+	errMark := "!"
+	if o.color {
+		errMark = "\x1b[31m!\x1b[0m"
+	}
+	return &labelWriter{o, o.stdout, prefix + " "}, &labelWriter{o, o.stderr, prefix + errMark + " "}
+}
+
+// labelWriter writes each given line with prefix.
+type labelWriter struct {
+	o      *Output
+	w      io.Writer
+	prefix string
+}
+
+func (lw *labelWriter) Write(line []byte) (int, error) {
+	lw.o.mu.Lock()
+	defer lw.o.mu.Unlock()
+	if _, err := io.WriteString(lw.w, lw.prefix); err != nil {
+		return 0, err
+	}
+	return lw.w.Write(line)
+}
+
+// copyLines copies r into w line by line, so that each Write gets a whole line.
+// The last line is terminated by a newline even if r does not end with it.
+func copyLines(w io.Writer, r io.Reader) error {
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if line[len(line)-1] != '\n' {
+				line = append(line, '\n')
+			}
+			if _, werr := w.Write(line); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
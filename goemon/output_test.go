@@ -0,0 +1,42 @@
+package goemon_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+func TestOutput_Writers(t *testing.T) {
+	tests := []struct {
+		name       string
+		label      string
+		color      bool
+		wantStdout string
+		wantStderr string
+	}{
+		{"labelled", "api", false, "[api] hello\n[api] partial\n", "[api]! oops\n"},
+		{"colored", "api", true, "\x1b[36m[api]\x1b[0m hello\n\x1b[36m[api]\x1b[0m partial\n", "\x1b[36m[api]\x1b[0m\x1b[31m!\x1b[0m oops\n"},
+		{"no label", "", true, "hello\npartial\n", "oops\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			out := goemon.NewOutput(&stdout, &stderr, tt.color)
+
+			p := goemon.NewProcess(`echo hello; echo oops >&2; printf partial`)
+			p.SetOutput(out.Writers(tt.label, 0))
+			if err := p.Start(); err != nil {
+				t.Fatal(err)
+			}
+			p.Wait()
+
+			if got := stdout.String(); got != tt.wantStdout {
+				t.Errorf("stdout = %q, want %q", got, tt.wantStdout)
+			}
+			if got := stderr.String(); got != tt.wantStderr {
+				t.Errorf("stderr = %q, want %q", got, tt.wantStderr)
+			}
+		})
+	}
+}
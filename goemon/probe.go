@@ -0,0 +1,122 @@
+package goemon
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// probeTimeout is the timeout of a single tcp or http check.
+const probeTimeout = time.Second
+
+// Probe checks whether a started command is ready.
+type Probe interface {
+	// Ready reports whether p started at since is ready.
+	Ready(p *Process, since time.Time) bool
+	String() string
+}
+
+// ParseProbe parses readiness probe spec.
+//
+//	tcp://host:port   the port accepts connections. host defaults to localhost.
+//	http://host/path  GET returns 2xx. https is supported as well.
+//	log:regexp        a line of output matches regexp.
+func ParseProbe(spec string) (Probe, error) {
+	switch {
+	case strings.HasPrefix(spec, "tcp://"):
+		addr := strings.TrimPrefix(spec, "tcp://")
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tcp probe %q: %v", spec, err)
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		return &tcpProbe{net.JoinHostPort(host, port)}, nil
+	case strings.HasPrefix(spec, "http://"), strings.HasPrefix(spec, "https://"):
+		return &httpProbe{spec, &http.Client{Timeout: probeTimeout}}, nil
+	case strings.HasPrefix(spec, "log:"):
+		re, err := regexp.Compile(strings.TrimPrefix(spec, "log:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid log probe %q: %v", spec, err)
+		}
+		return &logProbe{re}, nil
+	}
+	return nil, fmt.Errorf("unknown probe %q, must start with tcp://, http://, https:// or log:", spec)
+}
+
+type tcpProbe struct {
+	addr string
+}
+
+func (t *tcpProbe) Ready(p *Process, since time.Time) bool {
+	conn, err := net.DialTimeout("tcp", t.addr, probeTimeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func (t *tcpProbe) String() string {
+	return "tcp://" + t.addr
+}
+
+type httpProbe struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpProbe) Ready(p *Process, since time.Time) bool {
+	res, err := h.client.Get(h.url)
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode >= 200 && res.StatusCode < 300
+}
+
+func (h *httpProbe) String() string {
+	return h.url
+}
+
+type logProbe struct {
+	re *regexp.Regexp
+}
+
+func (l *logProbe) Ready(p *Process, since time.Time) bool {
+	for _, line := range p.LogsSince(since) {
+		if l.re.MatchString(line.Text) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *logProbe) String() string {
+	return "log:" + l.re.String()
+}
+
+// readiness is the readiness of a single start of Process.
+type readiness struct {
+	once sync.Once
+	done chan struct{}
+	err  error
+}
+
+func newReadiness() *readiness {
+	return &readiness{done: make(chan struct{})}
+}
+
+// resolve marks the start as ready if err is nil, or failed otherwise.
+// Only the first call takes effect.
+func (r *readiness) resolve(err error) {
+	r.once.Do(func() {
+		r.err = err
+		close(r.done)
+	})
+}
@@ -0,0 +1,106 @@
+package goemon_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+func TestProcess_WaitReady(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ok.Close()
+	ng := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ng.Close()
+
+	tests := []struct {
+		name    string
+		command string
+		probe   string
+		wantErr bool
+	}{
+		{"log", "sleep 0.2; echo listening on 8080; sleep 10", "log:listening on \\d+", false},
+		{"log timeout", "sleep 10", "log:listening", true},
+		{"tcp", "sleep 10", "tcp://" + l.Addr().String(), false},
+		{"http", "sleep 10", ok.URL, false},
+		{"http not 2xx", "sleep 10", ng.URL, true},
+		{"exited", "exit 1", "log:listening", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			probe, err := goemon.ParseProbe(tt.probe)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p := goemon.NewProcess(tt.command)
+			p.SetOutput(nopWriter{}, nopWriter{})
+			p.SetProbe(probe, time.Second)
+			if err := p.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer p.Stop()
+
+			if err := p.WaitReady(); (err != nil) != tt.wantErr {
+				t.Errorf("Process.WaitReady() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestProcess_WaitReadyPipeline(t *testing.T) {
+	probe, err := goemon.ParseProbe("log:listening")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The output of the earlier steps does not make the last command ready.
+	p := goemon.NewPipeline([]string{"echo listening", "sleep 10"})
+	p.SetOutput(nopWriter{}, nopWriter{})
+	p.SetProbe(probe, 500*time.Millisecond)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	if err := p.WaitReady(); err == nil {
+		t.Error("Process.WaitReady() error = nil, want not ready")
+	}
+}
+
+func TestParseProbe(t *testing.T) {
+	tests := []struct {
+		name    string
+		spec    string
+		want    string
+		wantErr bool
+	}{
+		{"tcp port only", "tcp://:8080", "tcp://localhost:8080", false},
+		{"http", "http://localhost:8080/health", "http://localhost:8080/health", false},
+		{"log", "log:ready", "log:ready", false},
+		{"invalid regexp", "log:(", "", true},
+		{"unknown", "udp://:53", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := goemon.ParseProbe(tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseProbe() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got.String() != tt.want {
+				t.Errorf("ParseProbe() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
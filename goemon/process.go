@@ -1,35 +1,108 @@
 package goemon
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
 
 // Process controls a command process.
 type Process struct {
+	mu         sync.Mutex
 	cmdStr     string
+	steps      []string
 	cmd        *exec.Cmd
 	exit       chan error
+	dir        string
+	env        []string
+	shell      string
+	execMode   bool
+	template   bool
+	stdout     io.Writer
+	stderr     io.Writer
 	errStdout  error
 	errStderr  error
+	logs       *LogBuffer
 	exitCode   int
+	exitSignal syscall.Signal
 	pid        int
 	verbose    bool
-	restarting chan int
 	started    time.Time
+	changes    ChangeSet
+
+	restarting     bool
+	restartPending bool
+	pendingChanges ChangeSet
+	cancelStale    bool
+	inStep         bool
+	canceled       bool
+
+	stopSignal  syscall.Signal
+	stopTimeout time.Duration
+
+	restartPolicy RestartPolicy
+	retries       int
+	retryTimer    *time.Timer
+	stopping      bool
+	closed        bool
+
+	crashLoopCount  int
+	crashLoopWindow time.Duration
+	failures        int
+	paused          bool
+
+	events   *eventHub
+	parent   *eventHub
+	finished chan error
+
+	probe        Probe
+	readyTimeout time.Duration
+	readiness    *readiness
 }
 
+// ErrCanceled is returned when a pipeline is canceled by newer changes.
+var ErrCanceled = errors.New("canceled by newer changes")
+
+// ErrNoCommand is returned when a process without commands is started.
+var ErrNoCommand = errors.New("no command to run")
+
+// ErrClosed is returned when a closed process is started.
+var ErrClosed = errors.New("process is closed")
+
 // NewProcess initializes Process.
 func NewProcess(command string) *Process {
+	return NewPipeline([]string{command})
+}
+
+// NewPipeline initializes Process which runs the given commands in order.
+// Every command but the last one must exit successfully before the next one
+// starts. Only the last command is kept running.
+func NewPipeline(commands []string) *Process {
 	p := &Process{}
-	p.cmdStr = command
+	p.cmdStr = strings.Join(commands, " -> ")
+	p.steps = commands
 	p.exit = make(chan error)
-	p.restarting = make(chan int, 2)
+	p.shell = "sh"
+	p.stdout = os.Stdout
+	p.stderr = os.Stderr
+	p.logs = NewLogBuffer(1000)
+	p.events = newEventHub()
+	p.finished = make(chan error, 1)
+	p.readyTimeout = 30 * time.Second
+	p.readiness = newReadiness()
+	p.readiness.resolve(fmt.Errorf("not started"))
+	p.stopSignal = syscall.SIGINT
+	p.stopTimeout = 5 * time.Second
+	p.restartPolicy = RestartPolicy{Mode: RestartNever}
+	p.crashLoopCount = 5
+	p.crashLoopWindow = 10 * time.Second
 	return p
 }
 
@@ -38,161 +111,818 @@ func (p *Process) SetVerbose(v bool) {
 	p.verbose = v
 }
 
+// SetCancelStale sets whether a restart requested while a pipeline step is
+// running cancels the step and starts over, instead of waiting for it.
+func (p *Process) SetCancelStale(v bool) {
+	p.cancelStale = v
+}
+
+// SetDir sets the working directory of the command. Empty means the current directory.
+func (p *Process) SetDir(dir string) {
+	p.dir = dir
+}
+
+// SetEnv sets environment variables in the form "KEY=value",
+// added to the environment inherited from goemon.
+func (p *Process) SetEnv(env []string) {
+	p.env = env
+}
+
+// SetShell sets the shell which runs the command with "-c".
+// It may contain arguments like "bash -o pipefail".
+func (p *Process) SetShell(shell string) {
+	p.shell = shell
+}
+
+// SetExec sets whether the command is run directly without a shell.
+// The command is split into arguments by SplitArgs.
+func (p *Process) SetExec(v bool) {
+	p.execMode = v
+}
+
+// SetTemplate sets whether the command is expanded as a template of CommandData
+// before it is run. It is off by default, as commands may contain "{{" themselves.
+func (p *Process) SetTemplate(v bool) {
+	p.template = v
+}
+
+// SetProbe sets the readiness probe of the command, and how long to wait for it.
+// Nil probe means the command is ready as soon as it is started.
+func (p *Process) SetProbe(probe Probe, timeout time.Duration) {
+	p.probe = probe
+	p.readyTimeout = timeout
+}
+
+// WaitReady waits until the last start of the command is ready.
+// It returns the error if the command failed to start, exited or
+// did not become ready within the timeout.
+func (p *Process) WaitReady() error {
+	p.mu.Lock()
+	r := p.readiness
+	p.mu.Unlock()
+
+	<-r.done
+	return r.err
+}
+
+// SetOutput sets writers which receive stdout and stderr of the command.
+// Each Write call receives a whole line.
+func (p *Process) SetOutput(stdout, stderr io.Writer) {
+	p.stdout = stdout
+	p.stderr = stderr
+}
+
+// SetLogSize sets the number of recent output lines kept in memory.
+func (p *Process) SetLogSize(n int) {
+	p.logs = NewLogBuffer(n)
+}
+
+// Logs returns the last n lines of command output. n <= 0 returns all kept lines.
+func (p *Process) Logs(n int) []LogLine {
+	return p.logs.Last(n)
+}
+
+// LogsSince returns the lines of command output written at or after t.
+func (p *Process) LogsSince(t time.Time) []LogLine {
+	return p.logs.Since(t)
+}
+
+// Subscribe returns a channel which receives lifecycle events of the process.
+// Events are dropped if the channel is not drained in time.
+func (p *Process) Subscribe() <-chan ProcessEvent {
+	return p.events.subscribe()
+}
+
+// Unsubscribe stops sending events to ch and closes it.
+func (p *Process) Unsubscribe(ch <-chan ProcessEvent) {
+	p.events.unsubscribe(ch)
+}
+
+// publish sends a lifecycle event to subscribers.
+func (p *Process) publish(typ ProcessEventType, err error) {
+	p.mu.Lock()
+	ev := ProcessEvent{
+		Type:     typ,
+		Process:  p,
+		Time:     time.Now(),
+		PID:      p.pid,
+		ExitCode: p.exitCode,
+		Signal:   p.exitSignal,
+		Err:      err,
+	}
+	parent := p.parent
+	p.mu.Unlock()
+
+	p.events.publish(ev)
+	if parent != nil {
+		parent.publish(ev)
+	}
+}
+
+// SetStopSignal sets the signal sent to stop the command.
+func (p *Process) SetStopSignal(sig syscall.Signal) {
+	p.stopSignal = sig
+}
+
+// SetStopTimeout sets how long to wait after the stop signal before killing the command.
+func (p *Process) SetStopTimeout(d time.Duration) {
+	p.stopTimeout = d
+}
+
+// SetRestartPolicy sets the policy to restart the command when it exits by itself.
+func (p *Process) SetRestartPolicy(r RestartPolicy) {
+	p.restartPolicy = r
+}
+
+// SetCrashLoop sets the crash loop threshold.
+// The command is paused when it fails count times in a row, each within window
+// after it started. Restarts by changes do not reset the count, only a run which
+// succeeded or lasted longer than window does.
+func (p *Process) SetCrashLoop(count int, window time.Duration) {
+	p.crashLoopCount = count
+	p.crashLoopWindow = window
+}
+
+// Paused returns if the command is paused by crash loop detection.
+// A paused command is not restarted until Start or Restart is called.
+func (p *Process) Paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
 // ExitCode returns the process id of the running command.
 func (p *Process) ExitCode() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.exitCode
 }
 
+// ExitSignal returns the signal which terminated the last command,
+// or 0 if it exited normally.
+func (p *Process) ExitSignal() syscall.Signal {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.exitSignal
+}
+
 // PID is the process id of the running command.
 func (p *Process) PID() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.pid
 }
 
 // Started returns started time.
 func (p *Process) Started() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
 	return p.started
 }
 
 // Start starts a command and wait to end.
+// If the process is a pipeline, the preceding steps are run to completion
+// first, and the first failing step aborts the rest.
 func (p *Process) Start() error {
+	if err := p.begin(); err != nil {
+		return err
+	}
+	return p.start()
+}
 
+// begin resets the retry and crash loop state for a new start.
+// It fails if the process can not be started.
+func (p *Process) begin() error {
+	if len(p.steps) == 0 {
+		return ErrNoCommand
+	}
 	if !p.Exited() {
 		return fmt.Errorf("process is running")
 	}
 
-	var stdoutBuf, stderrBuf bytes.Buffer
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return ErrClosed
+	}
+	p.stopping = false
+	p.retries = 0
+	p.cancelRetry()
+	if p.paused {
+		fmt.Printf("[goemon] resuming paused %v\n", p.cmdStr)
+		p.failures = 0
+	}
+	p.paused = false
+	p.mu.Unlock()
+	return nil
+}
 
-	cmd := exec.Command("sh", "-c", p.cmdStr)
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	p.cmd = cmd
+func (p *Process) start() error {
+	begin := time.Now()
+	ready := newReadiness()
+	p.mu.Lock()
+	p.readiness = ready
+	p.mu.Unlock()
+	p.publish(ProcessStarting, nil)
+
+	fail := func(err error) error {
+		ready.resolve(err)
+		p.publish(ProcessExited, err)
+		if p.takeCanceled() {
+			// Canceled steps are neither failures nor retried.
+			return ErrCanceled
+		}
+		p.exited(err, time.Since(begin))
+		return err
+	}
+
+	last := len(p.steps) - 1
+	for i, step := range p.steps[:last] {
+		if err := p.runStep(step); err != nil {
+			return fail(fmt.Errorf("step %d/%d %q failed: %v", i+1, len(p.steps), step, err))
+		}
+		if p.isCanceled() {
+			return fail(ErrCanceled)
+		}
+	}
+
+	cmd, err := p.command(p.steps[last])
+	if err != nil {
+		return fail(err)
+	}
 
 	stdoutIn, _ := cmd.StdoutPipe()
 	stderrIn, _ := cmd.StderrPipe()
 
-	stdout := io.MultiWriter(os.Stdout, &stdoutBuf)
-	stderr := io.MultiWriter(os.Stderr, &stderrBuf)
-	err := cmd.Start()
+	started := time.Now()
+	err = cmd.Start()
 	if err != nil {
-		return fmt.Errorf("cmd.Start() failed with '%s'", err)
+		return fail(fmt.Errorf("cmd.Start() failed with '%s'", err))
 	}
 
-	p.pid = p.cmd.Process.Pid
+	exit := make(chan error)
+	p.mu.Lock()
+	p.cmd = cmd
+	p.pid = cmd.Process.Pid
+	p.exit = exit
+	p.started = started
+	stopping := p.stopping
+	p.mu.Unlock()
+	p.publish(ProcessStarted, nil)
+	// Stop returns without signaling if it is called before the command started.
+	if stopping {
+		p.signal(p.stopSignal)
+	}
 
 	if p.verbose {
 		fmt.Println(p.String())
 	}
 
-	go func() {
-		_, p.errStdout = io.Copy(stdout, stdoutIn)
-	}()
-
-	go func() {
-		_, p.errStderr = io.Copy(stderr, stderrIn)
-	}()
-
-	p.exit = make(chan error)
-	p.started = time.Now()
+	copying := p.copyOutput(stdoutIn, stderrIn)
+	if p.probe == nil {
+		ready.resolve(nil)
+		p.publish(ProcessReady, nil)
+	} else {
+		go p.waitReady(ready, exit, begin, started)
+	}
 
 	go func() {
-		err := p.cmd.Wait()
+		copying.Wait()
+		err := cmd.Wait()
 		if err != nil {
 			fmt.Printf("cmd.Run() failed with %s\n", err)
 		}
-		s := p.cmd.ProcessState
-		p.exitCode = s.Sys().(syscall.WaitStatus).ExitStatus()
+		p.setExitStatus(cmd.ProcessState)
 
 		if p.verbose {
-			fmt.Println("process exited with", p.exitCode)
+			fmt.Println("process exited with", p.exitStatus())
 		}
 
-		close(p.exit)
+		p.mu.Lock()
 		p.cmd = nil
+		p.mu.Unlock()
+		ready.resolve(fmt.Errorf("%v exited before ready with %v", p.cmdStr, p.exitStatus()))
+		p.publish(ProcessExited, err)
+		close(exit)
+
+		p.exited(err, time.Since(begin))
 	}()
 
 	return nil
 }
 
+// waitReady probes the command started at started until it is ready,
+// exits or the ready timeout passes. The time to ready is reported from begin,
+// when the first step started.
+func (p *Process) waitReady(ready *readiness, exit chan error, begin, started time.Time) {
+	timeout := time.After(p.readyTimeout)
+	tick := time.NewTicker(100 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		if p.probe.Ready(p, started) {
+			ready.resolve(nil)
+			fmt.Printf("[goemon] %v is ready in %v\n", p.cmdStr, time.Since(begin).Round(time.Millisecond))
+			p.publish(ProcessReady, nil)
+			return
+		}
+
+		select {
+		case <-exit:
+			return
+		case <-timeout:
+			err := fmt.Errorf("%v is not ready within %v (%v)", p.cmdStr, p.readyTimeout, p.probe)
+			ready.resolve(err)
+			fmt.Println("[goemon]", err)
+			p.publish(ProcessReady, err)
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+// command creates the command to run step in its own process group.
+func (p *Process) command(step string) (*exec.Cmd, error) {
+	p.mu.Lock()
+	changes := p.changes
+	p.mu.Unlock()
+
+	if p.template {
+		var err error
+		if step, err = expandCommand(step, commandData(changes, p.dir)); err != nil {
+			return nil, err
+		}
+	}
+
+	var cmd *exec.Cmd
+	if p.execMode {
+		args, err := SplitArgs(step)
+		if err != nil {
+			return nil, err
+		}
+		if len(args) == 0 {
+			return nil, fmt.Errorf("empty command")
+		}
+		cmd = exec.Command(args[0], args[1:]...)
+	} else {
+		shell, err := SplitArgs(p.shell)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shell: %v", err)
+		}
+		if len(shell) == 0 {
+			shell = []string{"sh"}
+		}
+		cmd = exec.Command(shell[0], append(shell[1:], "-c", step)...)
+	}
+
+	cmd.Dir = p.dir
+	cmd.Env = append(append(os.Environ(), p.env...), changeEnv(changes, p.dir)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd, nil
+}
+
+// runStep runs a pipeline step and waits for it to exit.
+func (p *Process) runStep(step string) error {
+	cmd, err := p.command(step)
+	if err != nil {
+		return err
+	}
+
+	stdoutIn, _ := cmd.StdoutPipe()
+	stderrIn, _ := cmd.StderrPipe()
+
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cmd.Start() failed with '%s'", err)
+	}
+
+	exit := make(chan error)
+	p.mu.Lock()
+	p.cmd = cmd
+	p.pid = cmd.Process.Pid
+	p.exit = exit
+	p.inStep = true
+	stopping := p.stopping
+	p.mu.Unlock()
+
+	if p.verbose {
+		fmt.Printf("[PID: %v] %v\n", cmd.Process.Pid, step)
+	}
+	// Stop returns without signaling if it is called before the step started.
+	if stopping {
+		p.signal(p.stopSignal)
+	}
+
+	copying := p.copyOutput(stdoutIn, stderrIn)
+	copying.Wait()
+	err = cmd.Wait()
+	p.setExitStatus(cmd.ProcessState)
+
+	p.mu.Lock()
+	p.cmd = nil
+	p.inStep = false
+	p.mu.Unlock()
+	close(exit)
+	return err
+}
+
+// cancelStep interrupts the running pipeline step, which makes the pipeline
+// return ErrCanceled. The step is killed if it does not exit within the stop timeout.
+func (p *Process) cancelStep() {
+	p.mu.Lock()
+	if !p.inStep || p.cmd == nil || p.canceled {
+		p.mu.Unlock()
+		return
+	}
+	p.canceled = true
+	pid, exit := p.pid, p.exit
+	p.mu.Unlock()
+
+	fmt.Printf("[PID: %v] canceling stale step of %v\n", pid, p.cmdStr)
+	syscall.Kill(-pid, p.stopSignal)
+	go func() {
+		select {
+		case <-exit:
+		case <-time.After(p.stopTimeout):
+			syscall.Kill(-pid, syscall.SIGKILL)
+		}
+	}()
+}
+
+func (p *Process) isCanceled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.canceled
+}
+
+// takeCanceled reports whether the pipeline was canceled, and clears it.
+func (p *Process) takeCanceled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	canceled := p.canceled
+	p.canceled = false
+	return canceled
+}
+
+// copyOutput copies command outputs line by line into the output writers
+// and the log buffer until they are closed.
+func (p *Process) copyOutput(stdoutIn, stderrIn io.Reader) *sync.WaitGroup {
+	stdout := io.MultiWriter(p.stdout, &logWriter{p.logs, false})
+	stderr := io.MultiWriter(p.stderr, &logWriter{p.logs, true})
+
+	var copying sync.WaitGroup
+	copying.Add(2)
+	go func() {
+		defer copying.Done()
+		err := copyLines(stdout, stdoutIn)
+		p.mu.Lock()
+		p.errStdout = err
+		p.mu.Unlock()
+	}()
+
+	go func() {
+		defer copying.Done()
+		err := copyLines(stderr, stderrIn)
+		p.mu.Lock()
+		p.errStderr = err
+		p.mu.Unlock()
+	}()
+	return &copying
+}
+
+// setExitStatus records exit code and signal of the exited command.
+func (p *Process) setExitStatus(s *os.ProcessState) {
+	ws := s.Sys().(syscall.WaitStatus)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.exitCode = ws.ExitStatus()
+	p.exitSignal = 0
+	if ws.Signaled() {
+		p.exitSignal = ws.Signal()
+	}
+}
+
+// exitStatus describes how the last command exited.
+func (p *Process) exitStatus() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.exitSignal != 0 {
+		return "signal " + signalName(p.exitSignal)
+	}
+	return fmt.Sprintf("code %d", p.exitCode)
+}
+
+// exited restarts the command according to the restart policy
+// unless it was stopped on purpose. err is the reason of the exit, or nil if succeeded.
+func (p *Process) exited(err error, ran time.Duration) {
+	status := p.exitStatus()
+	name := p.String()
+
+	p.mu.Lock()
+	stopping := p.stopping
+	scheduled := p.scheduleRetry(err != nil, ran, name, status)
+	p.mu.Unlock()
+
+	if scheduled {
+		p.publish(ProcessRestarting, nil)
+		return
+	}
+	if !stopping {
+		select {
+		case p.finished <- err:
+		default:
+		}
+	}
+}
+
+// scheduleRetry schedules the restart, and reports whether it is scheduled. p.mu must be held.
+func (p *Process) scheduleRetry(failed bool, ran time.Duration, name, status string) bool {
+	if p.stopping {
+		return false
+	}
+	if !failed {
+		p.failures = 0
+	} else if p.crashLooping(ran) {
+		p.paused = true
+		// Pausing and giving up are always reported, retries only in verbose mode.
+		fmt.Println("[goemon] ========================================")
+		fmt.Printf("[goemon] crash loop detected: %v failed %d times in a row within %v of starting\n",
+			p.cmdStr, p.failures, p.crashLoopWindow)
+		fmt.Println("[goemon] last exit status:", status)
+		fmt.Println("[goemon] paused until the next change")
+		fmt.Println("[goemon] ========================================")
+		return false
+	}
+
+	r := p.restartPolicy
+	if !r.shouldRestart(failed) {
+		return false
+	}
+	if r.ResetAfter > 0 && ran >= r.ResetAfter {
+		p.retries = 0
+	}
+	if r.retriesExceeded(p.retries) {
+		fmt.Printf("[goemon] %v exited with %v, giving up after %d retries\n", name, status, p.retries)
+		return false
+	}
+
+	d := r.delay(p.retries)
+	p.retries++
+	if p.verbose {
+		fmt.Printf("%v exited with %v, restarting in %v (retry %d)\n", name, status, d, p.retries)
+	}
+	p.retryTimer = time.AfterFunc(d, p.retry)
+	return true
+}
+
+// crashLooping records a failure of a run which lasted ran, and reports whether
+// the command failed too many times in a row. A failure after running longer
+// than the crash loop window starts a new count. p.mu must be held.
+func (p *Process) crashLooping(ran time.Duration) bool {
+	if p.crashLoopCount <= 0 {
+		return false
+	}
+	if ran >= p.crashLoopWindow {
+		p.failures = 0
+	}
+	p.failures++
+	return p.failures >= p.crashLoopCount
+}
+
+// retry starts the command again unless it was stopped in the meantime.
+func (p *Process) retry() {
+	p.mu.Lock()
+	p.retryTimer = nil
+	stopping := p.stopping || p.paused
+	p.mu.Unlock()
+
+	if stopping || !p.Exited() {
+		return
+	}
+	if err := p.start(); err != nil {
+		fmt.Println(err)
+	}
+}
+
+// cancelRetry cancels the scheduled restart. p.mu must be held.
+func (p *Process) cancelRetry() {
+	if p.retryTimer != nil {
+		p.retryTimer.Stop()
+		p.retryTimer = nil
+	}
+}
+
 // Interrupt sends interrupt signal to its children process.
 func (p *Process) Interrupt() error {
 	if p.verbose {
 		fmt.Println("Send interrupt")
 	}
-	return syscall.Kill(-p.cmd.Process.Pid, syscall.SIGINT)
+	return p.signal(syscall.SIGINT)
 }
 
 // Kill sends kill signal to its children process.
 func (p *Process) Kill() error {
-	return syscall.Kill(-p.cmd.Process.Pid, syscall.SIGKILL)
+	return p.signal(syscall.SIGKILL)
+}
+
+// signal sends sig to the process group of the running command.
+func (p *Process) signal(sig syscall.Signal) error {
+	p.mu.Lock()
+	cmd := p.cmd
+	p.mu.Unlock()
+	if cmd == nil || cmd.Process == nil {
+		return nil
+	}
+	return syscall.Kill(-cmd.Process.Pid, sig)
 }
 
-// Stop kills command.
+// Stop sends the stop signal to the command, and kills it
+// if it does not exit within the stop timeout.
 func (p *Process) Stop() error {
 	if p.verbose {
 		fmt.Println("Stop process invoked")
 	}
 
+	p.mu.Lock()
+	p.stopping = true
+	p.cancelRetry()
+	p.mu.Unlock()
+
 	if p.Exited() {
 		return nil
 	}
 
-	if p.cmd != nil && p.cmd.Process != nil {
-		if err := p.Interrupt(); err != nil {
-			return err
-		}
+	p.mu.Lock()
+	exit := p.exit
+	p.mu.Unlock()
+
+	if p.verbose {
+		fmt.Println("Send", signalName(p.stopSignal))
+	}
+	if err := p.signal(p.stopSignal); err != nil {
+		return err
+	}
 
+	sent := p.stopSignal
+	if sent != syscall.SIGKILL {
 		select {
-		case <-time.After(5 * time.Second):
+		case <-time.After(p.stopTimeout):
+			fmt.Printf("%v did not stop within %v\n", p, p.stopTimeout)
 			if err := p.Kill(); err != nil {
 				return fmt.Errorf("failed to kill: %v", err)
 			}
-		case <-p.exit:
+			sent = syscall.SIGKILL
+		case <-exit:
 		}
 	}
+	<-exit
 
+	if p.verbose {
+		fmt.Printf("%v stopped with %v, exited with %v\n", p, signalName(sent), p.exitStatus())
+	}
+	p.publish(ProcessStopped, nil)
 	return nil
 }
 
+// Close stops the command for good. Starting it again fails with ErrClosed,
+// even if a restart is in progress.
+func (p *Process) Close() error {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	return p.Stop()
+}
+
 // Wait waits till the command stops.
 func (p *Process) Wait() error {
 	if p.Exited() {
 		return fmt.Errorf("Wait called but Process is not running")
 	}
 
-	<-p.exit
+	p.mu.Lock()
+	exit := p.exit
+	p.mu.Unlock()
 
-	if p.errStdout != nil || p.errStderr != nil {
+	<-exit
+
+	p.mu.Lock()
+	errStdout, errStderr := p.errStdout, p.errStderr
+	p.mu.Unlock()
+
+	if errStdout != nil || errStderr != nil {
 		if p.verbose {
-			fmt.Println("failed to capture stdout or stderr", p.errStdout, p.errStderr)
+			fmt.Println("failed to capture stdout or stderr", errStdout, errStderr)
 		}
 	}
 	return nil
 }
 
+// Run starts the command and blocks until ctx is done, then stops the command.
+// It returns early when the command exits and is not going to be restarted,
+// with the error if the command failed.
+func (p *Process) Run(ctx context.Context) error {
+	select {
+	case <-p.finished:
+	default:
+	}
+
+	if err := p.begin(); err != nil {
+		return err
+	}
+	// A failed start is returned through finished unless it is restarted.
+	if err := p.start(); err != nil && p.verbose {
+		fmt.Println(err)
+	}
+
+	select {
+	case <-ctx.Done():
+		return p.Stop()
+	case err := <-p.finished:
+		return err
+	}
+}
+
+// Changes returns the change set which triggered the last restart.
+func (p *Process) Changes() ChangeSet {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.changes
+}
+
 // Restart stops current process and starts a new process.
 func (p *Process) Restart() error {
-	fmt.Println("[debug] restart invoked")
-	if len(p.restarting) > 0 {
-		fmt.Println("[debug] restarting")
-		return fmt.Errorf("restarting")
+	return p.RestartWith(nil)
+}
+
+// RestartWith restarts the process triggered by the change set cs.
+// If a restart is in progress, the restart is queued and runs as soon as the
+// current one finished. Queued change sets are merged into one restart.
+func (p *Process) RestartWith(cs ChangeSet) error {
+	p.mu.Lock()
+	if p.restarting {
+		p.restartPending = true
+		for _, ev := range cs {
+			p.pendingChanges = p.pendingChanges.add(ev)
+		}
+		p.mu.Unlock()
+		if p.verbose {
+			fmt.Printf("%v restart queued\n", p)
+		}
+		if p.cancelStale {
+			p.cancelStep()
+		}
+		return nil
+	}
+	p.restarting = true
+	p.mu.Unlock()
+
+	for {
+		err := p.restart(cs)
+
+		p.mu.Lock()
+		if !p.restartPending {
+			p.restarting = false
+			p.mu.Unlock()
+			return err
+		}
+		if err != nil && err != ErrCanceled && err != ErrClosed {
+			fmt.Println(err)
+		}
+		cs = p.pendingChanges
+		p.restartPending = false
+		p.pendingChanges = nil
+		p.mu.Unlock()
 	}
-	p.restarting <- 1
+}
+
+// restart stops current process and starts a new process.
+func (p *Process) restart(cs ChangeSet) error {
+	p.mu.Lock()
+	p.changes = cs
+	p.mu.Unlock()
+	p.publish(ProcessRestarting, nil)
+	// Stop waits for the exit.
 	if !p.Exited() {
-		p.Stop()
-		err := p.Wait()
-		if err != nil {
+		if err := p.Stop(); err != nil {
 			fmt.Println(err)
 		}
 	}
 	err := p.Start()
-	<-p.restarting
+	if err == nil && p.probe != nil {
+		err = p.WaitReady()
+	}
 
-	fmt.Println("successfully restarted")
+	if err == nil {
+		fmt.Println("successfully restarted")
+	}
 	return err
 }
 
 // Exited returns if the command exited.
 func (p *Process) Exited() bool {
-	return p.cmd == nil || p.cmd.ProcessState != nil && p.cmd.ProcessState.Exited()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.cmd == nil
 }
 
 func (p *Process) String() string {
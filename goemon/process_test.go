@@ -0,0 +1,599 @@
+package goemon_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+func TestProcess_Pipeline(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "goemon_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	out := filepath.Join(tmpDir, "out")
+
+	tests := []struct {
+		name    string
+		steps   []string
+		wantErr bool
+		want    string
+	}{
+		{"in order", []string{"echo build >> " + out, "echo run >> " + out}, false, "build\nrun\n"},
+		{"abort on failure", []string{"echo build >> " + out, "exit 3", "echo run >> " + out}, true, "build\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(out)
+
+			p := goemon.NewPipeline(tt.steps)
+			err := p.Start()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Process.Start() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				p.Wait()
+			}
+
+			got, _ := ioutil.ReadFile(out)
+			if string(got) != tt.want {
+				t.Errorf("pipeline output = %q, want %q", got, tt.want)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "exit 3") {
+				t.Errorf("Process.Start() error = %v, want failing step in message", err)
+			}
+		})
+	}
+}
+
+func TestProcess_NoCommand(t *testing.T) {
+	for _, steps := range [][]string{nil, {}} {
+		if err := goemon.NewPipeline(steps).Start(); err != goemon.ErrNoCommand {
+			t.Errorf("Process.Start() of %q error = %v, want %v", steps, err, goemon.ErrNoCommand)
+		}
+	}
+}
+
+func TestProcess_RunStartError(t *testing.T) {
+	running := goemon.NewProcess("sleep 10")
+	running.SetOutput(nopWriter{}, nopWriter{})
+	if err := running.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer running.Stop()
+
+	tests := []struct {
+		name string
+		p    *goemon.Process
+	}{
+		{"no command", goemon.NewPipeline(nil)},
+		{"running", running},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			done := make(chan error)
+			go func() {
+				done <- tt.p.Run(context.Background())
+			}()
+			select {
+			case err := <-done:
+				if err == nil {
+					t.Error("Process.Run() error = nil, want the start error")
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Process.Run() did not return the start error")
+			}
+		})
+	}
+}
+
+func TestProcess_Stop(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		signal  syscall.Signal
+		want    syscall.Signal
+	}{
+		{"SIGTERM", "sleep 10", syscall.SIGTERM, syscall.SIGTERM},
+		{"SIGKILL", "sleep 10", syscall.SIGKILL, syscall.SIGKILL},
+		{"escalate to SIGKILL", "trap '' TERM; while true; do sleep 0.1; done", syscall.SIGTERM, syscall.SIGKILL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := goemon.NewProcess(tt.command)
+			p.SetStopSignal(tt.signal)
+			p.SetStopTimeout(300 * time.Millisecond)
+			if err := p.Start(); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(100 * time.Millisecond)
+
+			if err := p.Stop(); err != nil {
+				t.Fatalf("Process.Stop() error = %v", err)
+			}
+			if got := p.ExitSignal(); got != tt.want {
+				t.Errorf("Process.ExitSignal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		name    string
+		arg     string
+		want    syscall.Signal
+		wantErr bool
+	}{
+		{"full name", "SIGTERM", syscall.SIGTERM, false},
+		{"short name", "kill", syscall.SIGKILL, false},
+		{"number", "2", syscall.SIGINT, false},
+		{"unknown", "SIGFOO", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := goemon.ParseSignal(tt.arg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSignal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSignal() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcess_RestartPolicy(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "goemon_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	out := filepath.Join(tmpDir, "out")
+
+	tests := []struct {
+		name    string
+		command string
+		policy  goemon.RestartPolicy
+		want    string
+	}{
+		{"never", "echo run >> " + out + "; exit 1", goemon.RestartPolicy{Mode: goemon.RestartNever}, "run\n"},
+		{"on-failure gives up", "echo run >> " + out + "; exit 1", goemon.RestartPolicy{Mode: goemon.RestartOnFailure, MaxRetries: 2, Backoff: 10 * time.Millisecond}, "run\nrun\nrun\n"},
+		{"on-failure succeeded", "echo run >> " + out, goemon.RestartPolicy{Mode: goemon.RestartOnFailure, MaxRetries: 2, Backoff: 10 * time.Millisecond}, "run\n"},
+		{"always", "echo run >> " + out, goemon.RestartPolicy{Mode: goemon.RestartAlways, MaxRetries: 1, Backoff: 10 * time.Millisecond}, "run\nrun\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(out)
+
+			p := goemon.NewProcess(tt.command)
+			p.SetRestartPolicy(tt.policy)
+			if err := p.Start(); err != nil {
+				t.Fatal(err)
+			}
+			time.Sleep(300 * time.Millisecond)
+			p.Stop()
+
+			got, _ := ioutil.ReadFile(out)
+			if string(got) != tt.want {
+				t.Errorf("restarted output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcess_CrashLoop(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "goemon_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	out := filepath.Join(tmpDir, "out")
+
+	p := goemon.NewProcess("echo run >> " + out + "; exit 1")
+	p.SetRestartPolicy(goemon.RestartPolicy{Mode: goemon.RestartAlways, Backoff: 10 * time.Millisecond})
+	p.SetCrashLoop(3, time.Second)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	got, _ := ioutil.ReadFile(out)
+	if want := "run\nrun\nrun\n"; string(got) != want {
+		t.Errorf("output before pause = %q, want %q", got, want)
+	}
+	if !p.Paused() {
+		t.Fatal("Process.Paused() = false, want true")
+	}
+
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	if p.Paused() {
+		t.Error("Process.Paused() = true after Start, want false")
+	}
+}
+
+func TestProcess_CrashLoopDefaults(t *testing.T) {
+	// A storm of restarts by changes of a bad edit pauses the command by the default threshold.
+	p := goemon.NewProcess("exit 1")
+	p.SetOutput(nopWriter{}, nopWriter{})
+	for i := 0; i < 5; i++ {
+		if p.Paused() {
+			t.Fatalf("Process.Paused() = true after %d failures", i)
+		}
+		if err := p.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		waitExited(t, p)
+	}
+	waitPaused(t, p)
+}
+
+func TestProcess_CrashLoopBackoff(t *testing.T) {
+	// Failures count even if the backoff spreads them beyond the window.
+	p := goemon.NewProcess("exit 1")
+	p.SetOutput(nopWriter{}, nopWriter{})
+	p.SetRestartPolicy(goemon.RestartPolicy{Mode: goemon.RestartOnFailure, Backoff: 300 * time.Millisecond})
+	p.SetCrashLoop(4, time.Second)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	waitPaused(t, p)
+}
+
+func TestProcess_CrashLoopReset(t *testing.T) {
+	// A successful run resets the count.
+	tmpDir, err := ioutil.TempDir("", "goemon_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ok := filepath.Join(tmpDir, "ok")
+
+	p := goemon.NewProcess("test -f " + ok)
+	p.SetOutput(nopWriter{}, nopWriter{})
+	p.SetCrashLoop(3, time.Second)
+	for i, succeed := range []bool{false, false, true, false, false} {
+		if succeed {
+			ioutil.WriteFile(ok, nil, 0644)
+		} else {
+			os.Remove(ok)
+		}
+		if err := p.Restart(); err != nil {
+			t.Fatal(err)
+		}
+		waitExited(t, p)
+		if p.Paused() {
+			t.Fatalf("Process.Paused() = true after run %d", i+1)
+		}
+	}
+}
+
+// waitPaused waits until p is paused by crash loop detection.
+func waitPaused(t *testing.T, p *goemon.Process) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !p.Paused() {
+		if time.Now().After(deadline) {
+			t.Fatal("Process.Paused() = false, want true")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitExited waits until p exited.
+func waitExited(t *testing.T, p *goemon.Process) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for !p.Exited() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v did not exit", p)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestProcess_Restart(t *testing.T) {
+	p := goemon.NewProcess("sleep 10")
+	p.SetOutput(nopWriter{}, nopWriter{})
+	p.SetStopTimeout(300 * time.Millisecond)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	pid := p.PID()
+	if err := p.Restart(); err != nil {
+		t.Fatalf("Process.Restart() error = %v", err)
+	}
+	if p.Exited() || p.PID() == pid {
+		t.Errorf("Process.Restart() did not start a new command, PID %v -> %v", pid, p.PID())
+	}
+}
+
+func TestProcess_Close(t *testing.T) {
+	p := goemon.NewProcess("trap '' INT; echo trapped; while true; do sleep 0.1; done")
+	p.SetOutput(nopWriter{}, nopWriter{})
+	p.SetStopTimeout(300 * time.Millisecond)
+	probe, err := goemon.ParseProbe("log:trapped")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetProbe(probe, time.Second)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	// The restart must not interrupt the shell before the trap is set.
+	if err := p.WaitReady(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Close while the restart is stopping the command.
+	restarted := make(chan error)
+	go func() {
+		restarted <- p.Restart()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-restarted; err != goemon.ErrClosed {
+		t.Errorf("Process.Restart() error = %v, want %v", err, goemon.ErrClosed)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !p.Exited() {
+		p.Kill()
+		t.Error("the command is running after Close")
+	}
+	if err := p.Start(); err != goemon.ErrClosed {
+		t.Errorf("Process.Start() error = %v, want %v", err, goemon.ErrClosed)
+	}
+}
+
+func TestProcess_Subscribe(t *testing.T) {
+	p := goemon.NewProcess("sleep 10")
+	events := p.Subscribe()
+
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	p.Unsubscribe(events)
+
+	want := []goemon.ProcessEventType{goemon.ProcessStarting, goemon.ProcessStarted, goemon.ProcessReady, goemon.ProcessExited, goemon.ProcessStopped}
+	got := make([]goemon.ProcessEventType, 0, len(want))
+	for ev := range events {
+		if ev.Process != p {
+			t.Errorf("ProcessEvent.Process = %v, want %v", ev.Process, p)
+		}
+		got = append(got, ev.Type)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestProcess_Run(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		wantErr bool
+	}{
+		{"cancelled", "sleep 10", false},
+		{"exited", "true", false},
+		{"failed", "exit 2", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			p := goemon.NewProcess(tt.command)
+			err := p.Run(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Process.Run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !p.Exited() {
+				t.Error("Process.Exited() = false after Run returned")
+			}
+		})
+	}
+}
+
+func TestProcess_Environment(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "goemon_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tests := []struct {
+		name    string
+		command string
+		setup   func(p *goemon.Process)
+		want    string
+	}{
+		{"dir", "pwd", func(p *goemon.Process) { p.SetDir(tmpDir) }, tmpDir},
+		{"env", "echo $GOEMON_TEST", func(p *goemon.Process) { p.SetEnv([]string{"GOEMON_TEST=hello"}) }, "hello"},
+		{"shell", "false | true; echo $?", func(p *goemon.Process) { p.SetShell("bash -o pipefail") }, "1"},
+		{"exec", "echo '$HOME'", func(p *goemon.Process) { p.SetExec(true) }, "$HOME"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := goemon.NewProcess(tt.command)
+			p.SetOutput(nopWriter{}, nopWriter{})
+			tt.setup(p)
+			if err := p.Start(); err != nil {
+				t.Fatal(err)
+			}
+			p.Wait()
+
+			got := logTexts(p.Logs(0))
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProcess_RestartQueued(t *testing.T) {
+	// The first step keeps each restart in progress for a while.
+	p := goemon.NewPipeline([]string{"sleep 0.3", "sleep 10"})
+	p.SetOutput(nopWriter{}, nopWriter{})
+	// A queued restart may signal the shell before it starts the command.
+	p.SetStopTimeout(100 * time.Millisecond)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+	events := p.Subscribe()
+
+	var wg sync.WaitGroup
+	for i, f := range []string{"/a", "/b", "/c"} {
+		wg.Add(1)
+		go func(f string) {
+			defer wg.Done()
+			p.RestartWith(goemon.ChangeSet{{Op: goemon.Write, Path: f}})
+		}(f)
+		if i == 0 {
+			// Let the first restart begin.
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+	p.Unsubscribe(events)
+
+	restarts := 0
+	for ev := range events {
+		if ev.Type == goemon.ProcessRestarting {
+			restarts++
+		}
+	}
+	if restarts != 2 {
+		t.Errorf("restarted %d times, want 2", restarts)
+	}
+	got := p.Changes().Files()
+	sort.Strings(got)
+	if want := []string{"/b", "/c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Changes() = %v, want %v", got, want)
+	}
+}
+
+func TestProcess_CancelStale(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "goemon_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	slow := filepath.Join(tmpDir, "slow")
+
+	// The build step is slow while the marker exists.
+	p := goemon.NewPipeline([]string{"if [ -e " + slow + " ]; then sleep 5; fi", "sleep 10"})
+	p.SetOutput(nopWriter{}, nopWriter{})
+	p.SetCancelStale(true)
+	p.SetStopTimeout(100 * time.Millisecond)
+	if err := p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	ioutil.WriteFile(slow, []byte{}, 0644)
+	done := make(chan error, 1)
+	begin := time.Now()
+	go func() {
+		done <- p.RestartWith(goemon.ChangeSet{{Op: goemon.Write, Path: "/a"}})
+	}()
+	time.Sleep(200 * time.Millisecond)
+	os.Remove(slow)
+	if err := p.RestartWith(goemon.ChangeSet{{Op: goemon.Write, Path: "/b"}}); err != nil {
+		t.Errorf("queued Process.RestartWith() error = %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Process.RestartWith() error = %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("stale step was not canceled")
+	}
+	if d := time.Since(begin); d > 2*time.Second {
+		t.Errorf("restart took %v", d)
+	}
+	if got := p.Changes().Files(); !reflect.DeepEqual(got, []string{"/b"}) {
+		t.Errorf("Changes() = %v, want [/b]", got)
+	}
+	if p.Exited() {
+		t.Error("process is not running after the follow-up restart")
+	}
+}
+
+func TestProcess_ChangeSet(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "goemon_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	writeFiles(t, tmpDir, map[string]string{"main.go": "", "pkg/a b/c.go": ""})
+
+	cs := goemon.ChangeSet{
+		{Op: goemon.Write, Path: filepath.Join(tmpDir, "main.go")},
+		{Op: goemon.Create | goemon.Write, Path: filepath.Join(tmpDir, "pkg/a b/c.go")},
+		{Op: goemon.Remove, Path: filepath.Join(tmpDir, "pkg/a b/d.go")},
+	}
+	tests := []struct {
+		name     string
+		command  string
+		exec     bool
+		template bool
+		cs       goemon.ChangeSet
+		want     string
+	}{
+		{"env files", "echo $GOEMON_CHANGED_FILES", false, false, cs, "main.go 'pkg/a b/c.go' 'pkg/a b/d.go'"},
+		{"env ops", "echo $GOEMON_EVENT_OPS", false, false, cs, "write create|write remove"},
+		{"files", "echo {{.Files}}", false, true, cs, "main.go pkg/a b/c.go"},
+		{"dirs", "echo {{.Dirs}}", false, true, cs, ". pkg/a b"},
+		{"range", "echo {{range .Dirs}}./{{.}}/... {{end}}", false, true, cs[1:], "./pkg/a b/..."},
+		{"exec", "echo {{.Dirs}}", true, true, cs, ". pkg/a b"},
+		{"no changes", "echo x{{.Files}}x", false, true, nil, "xx"},
+		{"removed only", "echo x{{.Files}}x", false, true, cs[2:], "xx"},
+		{"template disabled", "echo '{{.ImportPath}}'", false, false, cs, "{{.ImportPath}}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := goemon.NewProcess(tt.command)
+			p.SetOutput(nopWriter{}, nopWriter{})
+			p.SetDir(tmpDir)
+			p.SetExec(tt.exec)
+			p.SetTemplate(tt.template)
+			if err := p.RestartWith(tt.cs); err != nil {
+				t.Fatal(err)
+			}
+			p.Wait()
+
+			got := logTexts(p.Logs(0))
+			if len(got) != 1 || got[0] != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
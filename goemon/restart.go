@@ -0,0 +1,67 @@
+package goemon
+
+import (
+	"fmt"
+	"time"
+)
+
+// Restart policy modes.
+const (
+	RestartNever     = "never"
+	RestartOnFailure = "on-failure"
+	RestartAlways    = "always"
+)
+
+// RestartPolicy decides whether a command which exited by itself is started again.
+type RestartPolicy struct {
+	Mode string
+	// MaxRetries is the number of consecutive restarts before giving up. 0 means unlimited.
+	MaxRetries int
+	// Backoff is the delay before the first restart, doubled on each retry.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between restarts.
+	MaxBackoff time.Duration
+	// ResetAfter resets the retry count when the command kept running longer than this.
+	ResetAfter time.Duration
+}
+
+// ValidateRestartMode checks mode is one of the restart policy modes.
+func ValidateRestartMode(mode string) error {
+	switch mode {
+	case RestartNever, RestartOnFailure, RestartAlways:
+		return nil
+	}
+	return fmt.Errorf("unknown restart policy %q, must be one of %v, %v or %v",
+		mode, RestartNever, RestartOnFailure, RestartAlways)
+}
+
+// shouldRestart reports whether a command exited with failed status is restarted.
+func (r RestartPolicy) shouldRestart(failed bool) bool {
+	switch r.Mode {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return failed
+	}
+	return false
+}
+
+// retriesExceeded reports whether retries reached the limit.
+func (r RestartPolicy) retriesExceeded(retries int) bool {
+	return r.MaxRetries > 0 && retries >= r.MaxRetries
+}
+
+// delay returns the backoff delay before the restart after retries.
+func (r RestartPolicy) delay(retries int) time.Duration {
+	d := r.Backoff
+	for i := 0; i < retries; i++ {
+		d *= 2
+		if r.MaxBackoff > 0 && d >= r.MaxBackoff {
+			return r.MaxBackoff
+		}
+	}
+	if r.MaxBackoff > 0 && d > r.MaxBackoff {
+		return r.MaxBackoff
+	}
+	return d
+}
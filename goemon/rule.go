@@ -0,0 +1,154 @@
+package goemon
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/gobwas/glob"
+)
+
+// Rule actions.
+const (
+	// ActionRestart restarts the named command.
+	ActionRestart = "restart"
+	// ActionRun runs a command once and waits for it to exit.
+	ActionRun = "run"
+)
+
+// Action is a step of Rule.
+type Action struct {
+	// Kind is ActionRestart or ActionRun.
+	Kind string
+	// Target is the command name for ActionRestart, or the command line for ActionRun.
+	Target string
+}
+
+func (a Action) String() string {
+	if a.Kind == ActionRun {
+		return fmt.Sprintf("%v %q", a.Kind, a.Target)
+	}
+	return a.Kind + " " + a.Target
+}
+
+// Rule maps changes of files matching Patterns by Ops to Actions.
+type Rule struct {
+	Patterns []string
+	Ops      Op
+	Actions  []Action
+	globs    []glob.Glob
+}
+
+// ParseRule parses a rule like
+//
+//	web/**/*.scss -> run "make css"
+//	migrations/*.sql on create,remove -> run "make migrate" then restart api
+//
+// Patterns are comma-separated or space-separated globbing patterns,
+// optionally followed by "on" and the operations in the format of ParseOps.
+// Actions are run in order, and the rest are skipped if a run fails.
+func ParseRule(s string) (*Rule, error) {
+	i := strings.Index(s, "->")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid rule %q, must be \"patterns -> actions\"", s)
+	}
+
+	r := &Rule{Ops: AllOps}
+	r.Patterns = strings.Fields(strings.Replace(s[:i], ",", " ", -1))
+	for j, p := range r.Patterns {
+		if p == "on" {
+			if j+1 == len(r.Patterns) {
+				return nil, fmt.Errorf("invalid rule %q, no operations after \"on\"", s)
+			}
+			ops, err := ParseOps(r.Patterns[j+1:])
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %q: %v", s, err)
+			}
+			r.Patterns, r.Ops = r.Patterns[:j], ops
+			break
+		}
+	}
+	if len(r.Patterns) == 0 {
+		return nil, fmt.Errorf("invalid rule %q, no patterns", s)
+	}
+	for _, p := range r.Patterns {
+		if _, err := glob.Compile(p, '/', filepath.Separator); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", s, err)
+		}
+	}
+	r.globs = CompileGlobs(r.Patterns)
+
+	words, err := SplitArgs(s[i+2:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid rule %q: %v", s, err)
+	}
+	for len(words) > 0 {
+		if len(r.Actions) > 0 {
+			if words[0] != "then" {
+				return nil, fmt.Errorf("invalid rule %q, expected \"then\" before %q", s, words[0])
+			}
+			words = words[1:]
+		}
+		if len(words) < 2 || (words[0] != ActionRestart && words[0] != ActionRun) {
+			return nil, fmt.Errorf("invalid rule %q, actions must be \"restart name\" or \"run command\"", s)
+		}
+		r.Actions = append(r.Actions, Action{Kind: words[0], Target: words[1]})
+		words = words[2:]
+	}
+	if len(r.Actions) == 0 {
+		return nil, fmt.Errorf("invalid rule %q, no actions", s)
+	}
+	return r, nil
+}
+
+// Match reports whether the relative path matches the patterns of the rule.
+func (r *Rule) Match(rel string) bool {
+	return matchGlobs(r.globs, rel)
+}
+
+func (r *Rule) String() string {
+	actions := make([]string, 0, len(r.Actions))
+	for _, a := range r.Actions {
+		actions = append(actions, a.String())
+	}
+	patterns := strings.Join(r.Patterns, ",")
+	if r.Ops != AllOps {
+		patterns += " on " + strings.Replace(r.Ops.String(), "|", ",", -1)
+	}
+	return patterns + " -> " + strings.Join(actions, " then ")
+}
+
+// ruleMatch is a rule and the changes matching it.
+type ruleMatch struct {
+	rule    *Rule
+	changes ChangeSet
+}
+
+// matchRules splits the change set cs by rules.
+// It returns the matches in the order of rules, and the changes matching no rule.
+// Changes matching the patterns of a rule but not its operations are dropped.
+func matchRules(rules []*Rule, cs ChangeSet, rel func(string) string) ([]ruleMatch, ChangeSet) {
+	matches := make([]ruleMatch, 0, len(rules))
+	var rest ChangeSet
+	matched := make(map[string]bool)
+	for _, r := range rules {
+		var changes ChangeSet
+		for _, ev := range cs {
+			if r.Match(rel(ev.Path)) || (ev.OldPath != "" && r.Match(rel(ev.OldPath))) {
+				if ev.Op&r.Ops != 0 {
+					changes = append(changes, ev)
+				}
+				matched[ev.Path] = true
+			}
+		}
+		if len(changes) > 0 {
+			matches = append(matches, ruleMatch{r, changes})
+		}
+	}
+	for _, ev := range cs {
+		if !matched[ev.Path] {
+			rest = append(rest, ev)
+		}
+	}
+	return matches, rest
+}
@@ -0,0 +1,138 @@
+package goemon_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     string
+		patterns []string
+		actions  []goemon.Action
+		wantErr  bool
+	}{
+		{"restart", "*.go -> restart api", []string{"*.go"},
+			[]goemon.Action{{Kind: goemon.ActionRestart, Target: "api"}}, false},
+		{"run", `web/**/*.scss -> run "make css"`, []string{"web/**/*.scss"},
+			[]goemon.Action{{Kind: goemon.ActionRun, Target: "make css"}}, false},
+		{"then", `migrations/*.sql -> run "make migrate" then restart api`, []string{"migrations/*.sql"},
+			[]goemon.Action{{Kind: goemon.ActionRun, Target: "make migrate"}, {Kind: goemon.ActionRestart, Target: "api"}}, false},
+		{"patterns", "*.go, go.mod go.sum->restart 0", []string{"*.go", "go.mod", "go.sum"},
+			[]goemon.Action{{Kind: goemon.ActionRestart, Target: "0"}}, false},
+		{"no arrow", "*.go restart api", nil, nil, true},
+		{"no patterns", "-> restart api", nil, nil, true},
+		{"no actions", "*.go ->", nil, nil, true},
+		{"unknown action", "*.go -> stop api", nil, nil, true},
+		{"missing target", "*.go -> restart", nil, nil, true},
+		{"missing then", "*.go -> restart api restart worker", nil, nil, true},
+		{"unterminated quote", `*.go -> run "make`, nil, nil, true},
+		{"invalid pattern", "[*.go -> restart api", nil, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := goemon.ParseRule(tt.rule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got.Patterns, tt.patterns) {
+				t.Errorf("ParseRule().Patterns = %v, want %v", got.Patterns, tt.patterns)
+			}
+			if !reflect.DeepEqual(got.Actions, tt.actions) {
+				t.Errorf("ParseRule().Actions = %v, want %v", got.Actions, tt.actions)
+			}
+		})
+	}
+}
+
+func TestParseRule_Ops(t *testing.T) {
+	tests := []struct {
+		rule     string
+		patterns []string
+		ops      goemon.Op
+		str      string
+		wantErr  bool
+	}{
+		{"*.go -> restart api", []string{"*.go"}, goemon.AllOps, "*.go -> restart api", false},
+		{"migrations/* on create,remove -> restart api", []string{"migrations/*"}, goemon.Create | goemon.Remove,
+			"migrations/* on create,remove -> restart api", false},
+		{"*.go, *.sh on !chmod -> restart api", []string{"*.go", "*.sh"}, goemon.AllOps &^ goemon.Chmod,
+			"*.go,*.sh on create,write,remove,rename,move -> restart api", false},
+		{"*.go on -> restart api", nil, 0, "", true},
+		{"*.go on touch -> restart api", nil, 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			got, err := goemon.ParseRule(tt.rule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseRule() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got.Patterns, tt.patterns) || got.Ops != tt.ops {
+				t.Errorf("ParseRule() = %v %v, want %v %v", got.Patterns, got.Ops, tt.patterns, tt.ops)
+			}
+			if got.String() != tt.str {
+				t.Errorf("Rule.String() = %v, want %v", got.String(), tt.str)
+			}
+		})
+	}
+}
+
+func TestRule_Match(t *testing.T) {
+	tests := []struct {
+		rule string
+		path string
+		want bool
+	}{
+		{"*.go -> restart api", "main.go", true},
+		{"*.go -> restart api", "cmd/api/main.go", true},
+		{"*.go -> restart api", "web/app.scss", false},
+		{"web/**/*.scss -> run make", "web/css/app.scss", true},
+		{"web/**/*.scss -> run make", "lib/css/app.scss", false},
+		{"Makefile -> run make", "Makefile", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule+" "+tt.path, func(t *testing.T) {
+			r, err := goemon.ParseRule(tt.rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Match(tt.path); got != tt.want {
+				t.Errorf("Rule.Match(%v) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOption_ValidateRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []string
+		wantErr bool
+	}{
+		{"named", []string{"*.go -> restart api"}, false},
+		{"index", []string{"*.go -> restart 0"}, false},
+		{"index out of range", []string{"*.go -> restart 1"}, true},
+		{"negative index", []string{"*.go -> restart -1"}, true},
+		{"run", []string{"*.css -> run 'make css'"}, false},
+		{"unknown name", []string{"*.go -> restart worker"}, true},
+		{"invalid", []string{"*.go"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := &goemon.Option{Names: []string{"api"}, Rules: tt.rules}
+			opt.Default()
+			if err := opt.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Option.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package goemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Environment variables set for commands, describing the changes which triggered them.
+// Both are space-separated, in the same order. They are empty on the first start.
+const (
+	// EnvChangedFiles lists the changed files, relative to the working directory of the command.
+	EnvChangedFiles = "GOEMON_CHANGED_FILES"
+	// EnvEventOps lists the operations of the changed files, like "write" or "create|write".
+	EnvEventOps = "GOEMON_EVENT_OPS"
+)
+
+// Paths is a list of paths, which is formatted as space-separated words
+// quoted for the shell if needed.
+type Paths []string
+
+func (ps Paths) String() string {
+	quoted := make([]string, 0, len(ps))
+	for _, p := range ps {
+		quoted = append(quoted, shellQuote(p))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes s with single quotes, unless it consists of safe characters only.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_-+=.,:/@%") == "" {
+		return s
+	}
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// CommandData is the data of command templates, which are expanded if enabled
+// by Process.SetTemplate.
+//
+//	golangci-lint run {{.Dirs}}
+type CommandData struct {
+	// Files are the changed files which exist. Removed files and the old
+	// paths of renamed ones are left out, so that commands can open them.
+	Files Paths
+	// Dirs are the directories of Files.
+	Dirs Paths
+}
+
+// commandData returns the template data of the change set cs,
+// with the paths relative to dir.
+func commandData(cs ChangeSet, dir string) CommandData {
+	data := CommandData{Files: Paths{}, Dirs: Paths{}}
+	seen := make(map[string]bool)
+	for _, ev := range cs {
+		if _, err := os.Lstat(ev.Path); err != nil {
+			continue
+		}
+		f := relTo(dir, ev.Path)
+		data.Files = append(data.Files, f)
+
+		d := f
+		if !ev.IsDir {
+			d = filepath.Dir(f)
+		}
+		if !seen[d] {
+			seen[d] = true
+			data.Dirs = append(data.Dirs, d)
+		}
+	}
+	return data
+}
+
+// relTo returns path relative to dir, or the current directory if dir is empty.
+func relTo(dir, path string) string {
+	base, err := filepath.Abs(dir)
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(base, path)
+	if err != nil {
+		return path
+	}
+	return rel
+}
+
+// expandCommand executes command as a template of CommandData.
+func expandCommand(command string, data CommandData) (string, error) {
+	if !strings.Contains(command, "{{") {
+		return command, nil
+	}
+	t, err := template.New("command").Parse(command)
+	if err != nil {
+		return "", fmt.Errorf("invalid command template: %v", err)
+	}
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("invalid command template: %v", err)
+	}
+	return b.String(), nil
+}
+
+// changeEnv returns the environment variables describing the change set cs,
+// with the paths relative to dir.
+func changeEnv(cs ChangeSet, dir string) []string {
+	files := make([]string, 0, len(cs))
+	ops := make([]string, 0, len(cs))
+	for _, ev := range cs {
+		files = append(files, shellQuote(relTo(dir, ev.Path)))
+		ops = append(ops, ev.Op.String())
+	}
+	return []string{
+		EnvChangedFiles + "=" + strings.Join(files, " "),
+		EnvEventOps + "=" + strings.Join(ops, " "),
+	}
+}
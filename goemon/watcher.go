@@ -0,0 +1,158 @@
+package goemon
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Op is a set of file operations.
+type Op uint32
+
+// File operations.
+const (
+	Create Op = 1 << iota
+	Write
+	Remove
+	Rename
+	Move
+	Chmod
+
+	// AllOps is the set of all file operations.
+	AllOps = Create | Write | Remove | Rename | Move | Chmod
+)
+
+var opNames = []struct {
+	op   Op
+	name string
+}{
+	{Create, "create"},
+	{Write, "write"},
+	{Remove, "remove"},
+	{Rename, "rename"},
+	{Move, "move"},
+	{Chmod, "chmod"},
+}
+
+func (o Op) String() string {
+	names := make([]string, 0, 1)
+	for _, v := range opNames {
+		if o&v.op != 0 {
+			names = append(names, v.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// ParseOps parses names of operations separated by commas or "|", like
+// "create,remove". Names prefixed with "!" are excluded, from all operations
+// if no name is included, so that "!chmod" is every operation but chmod.
+// No names are all operations.
+func ParseOps(names []string) (Op, error) {
+	var include, exclude Op
+	for _, v := range names {
+		for _, name := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == '|' }) {
+			name = strings.TrimSpace(name)
+			negate := strings.HasPrefix(name, "!")
+			name = strings.TrimPrefix(name, "!")
+			op, ok := Op(0), false
+			for _, v := range opNames {
+				if strings.EqualFold(v.name, name) {
+					op, ok = v.op, true
+				}
+			}
+			if !ok {
+				return 0, fmt.Errorf("unknown operation %q", name)
+			}
+			if negate {
+				exclude |= op
+			} else {
+				include |= op
+			}
+		}
+	}
+	if include == 0 {
+		include = AllOps
+	}
+	return include &^ exclude, nil
+}
+
+// FileEvent is a change of a watched file or directory.
+type FileEvent struct {
+	Op Op
+	// Path is the absolute path of the changed file.
+	Path string
+	// OldPath is the path before Rename or Move.
+	OldPath string
+	IsDir   bool
+	ModTime time.Time
+}
+
+func (e FileEvent) String() string {
+	kind := "FILE"
+	if e.IsDir {
+		kind = "DIRECTORY"
+	}
+	if e.OldPath != "" && e.OldPath != e.Path {
+		return fmt.Sprintf("%s %v %q -> %q", kind, e.Op, e.OldPath, e.Path)
+	}
+	return fmt.Sprintf("%s %v %q", kind, e.Op, e.Path)
+}
+
+// ErrOverflow is sent to Errors of Watcher when events were lost.
+// Changes since then are unknown, and the watched paths must be rescanned.
+var ErrOverflow = errors.New("watcher event queue overflowed")
+
+// Watcher watches files and directories.
+//
+// Adding a directory watches the directory itself and its direct children.
+// Events are reported with absolute paths.
+type Watcher interface {
+	// Add starts watching path.
+	Add(path string) error
+	// Remove stops watching path.
+	Remove(path string) error
+	// WatchedFiles returns absolute paths of watched files.
+	WatchedFiles() []string
+	// Events returns the channel of file events, which is closed when the watcher is closed.
+	Events() <-chan FileEvent
+	// Errors returns the channel of watch errors.
+	Errors() <-chan error
+	// Start starts watching and blocks until Close is called.
+	Start() error
+	// Close stops watching.
+	Close() error
+}
+
+// Watcher backends.
+const (
+	// BackendNative uses the file notification API of the OS if it is supported,
+	// or falls back to BackendPoll.
+	BackendNative = "native"
+	// BackendPoll polls files every 200ms.
+	BackendPoll = "poll"
+)
+
+// ValidateBackend checks backend is one of the watcher backends.
+func ValidateBackend(backend string) error {
+	switch backend {
+	case BackendNative, BackendPoll:
+		return nil
+	}
+	return fmt.Errorf("unknown watcher backend %q, must be %v or %v", backend, BackendNative, BackendPoll)
+}
+
+// NewWatcher initializes Watcher of backend.
+func NewWatcher(backend string) (Watcher, error) {
+	switch backend {
+	case BackendNative:
+		return NewNativeWatcher()
+	case BackendPoll:
+		return NewPollWatcher(200 * time.Millisecond), nil
+	}
+	return nil, ValidateBackend(backend)
+}
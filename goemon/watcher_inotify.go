@@ -0,0 +1,352 @@
+//go:build linux
+// +build linux
+
+package goemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// inotifyWatcher is Watcher using Linux inotify.
+//
+// inotify watches directories, so a watched file is watched through
+// its parent directory, and events of unwatched siblings are dropped.
+type inotifyWatcher struct {
+	fd     int
+	wake   [2]int
+	events chan FileEvent
+	errors chan error
+	done   chan struct{}
+
+	mu      sync.Mutex
+	wds     map[int]string
+	dirs    map[string]int
+	watched map[string]bool
+	started bool
+	closed  bool
+}
+
+// NewNativeWatcher initializes Watcher using inotify.
+func NewNativeWatcher() (Watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %v", err)
+	}
+	iw := &inotifyWatcher{
+		fd:      fd,
+		events:  make(chan FileEvent),
+		errors:  make(chan error),
+		done:    make(chan struct{}),
+		wds:     make(map[int]string),
+		dirs:    make(map[string]int),
+		watched: make(map[string]bool),
+	}
+	if err := syscall.Pipe2(iw.wake[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("pipe2: %v", err)
+	}
+	return iw, nil
+}
+
+func (iw *inotifyWatcher) Add(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+
+	dir := path
+	if !fi.IsDir() {
+		dir = filepath.Dir(path)
+	}
+	if err := iw.addDir(dir); err != nil {
+		return err
+	}
+	iw.watched[path] = true
+	return nil
+}
+
+// addDir adds inotify watch of dir. iw.mu must be held.
+func (iw *inotifyWatcher) addDir(dir string) error {
+	if _, ok := iw.dirs[dir]; ok {
+		return nil
+	}
+	wd, err := syscall.InotifyAddWatch(iw.fd, dir, inotifyMask)
+	if err != nil {
+		return &os.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+	iw.wds[wd] = dir
+	iw.dirs[dir] = wd
+	return nil
+}
+
+func (iw *inotifyWatcher) Remove(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+
+	delete(iw.watched, path)
+
+	// Keep the directory watch while it or any of its children is watched.
+	for _, dir := range []string{path, filepath.Dir(path)} {
+		wd, ok := iw.dirs[dir]
+		if !ok || iw.needsDir(dir) {
+			continue
+		}
+		syscall.InotifyRmWatch(iw.fd, uint32(wd))
+		delete(iw.wds, wd)
+		delete(iw.dirs, dir)
+	}
+	return nil
+}
+
+// needsDir reports whether dir or any of its children is watched. iw.mu must be held.
+func (iw *inotifyWatcher) needsDir(dir string) bool {
+	if iw.watched[dir] {
+		return true
+	}
+	for p := range iw.watched {
+		if filepath.Dir(p) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+func (iw *inotifyWatcher) WatchedFiles() []string {
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+	files := make([]string, 0, len(iw.watched))
+	for k := range iw.watched {
+		files = append(files, k)
+	}
+	return files
+}
+
+func (iw *inotifyWatcher) Events() <-chan FileEvent {
+	return iw.events
+}
+
+func (iw *inotifyWatcher) Errors() <-chan error {
+	return iw.errors
+}
+
+func (iw *inotifyWatcher) Start() error {
+	iw.mu.Lock()
+	if iw.closed {
+		iw.mu.Unlock()
+		return nil
+	}
+	iw.started = true
+	iw.mu.Unlock()
+
+	defer iw.release()
+
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("epoll_create1: %v", err)
+	}
+	defer syscall.Close(epfd)
+
+	for _, fd := range []int{iw.fd, iw.wake[0]} {
+		ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+		if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+			return fmt.Errorf("epoll_ctl: %v", err)
+		}
+	}
+
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	ready := make([]syscall.EpollEvent, 2)
+	for {
+		n, err := syscall.EpollWait(epfd, ready, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("epoll_wait: %v", err)
+		}
+		for _, ev := range ready[:n] {
+			if int(ev.Fd) == iw.wake[0] {
+				return nil
+			}
+		}
+		if err := iw.read(buf); err != nil {
+			iw.sendError(err)
+		}
+	}
+}
+
+// read reads available inotify events and sends them.
+func (iw *inotifyWatcher) read(buf []byte) error {
+	// Moves are paired by cookie within a read. Unpaired ones are moves
+	// from or to unwatched directories.
+	movedFrom := make(map[uint32]FileEvent)
+	var order []uint32
+
+	for {
+		n, err := syscall.Read(iw.fd, buf)
+		if err == syscall.EAGAIN || err == syscall.EINTR {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read inotify: %v", err)
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			start := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[start:start+int(raw.Len)]), "\x00")
+			offset = start + int(raw.Len)
+
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				iw.sendError(ErrOverflow)
+				continue
+			}
+
+			ev, ok := iw.convert(int(raw.Wd), raw.Mask, name)
+			if !ok {
+				continue
+			}
+			switch {
+			case raw.Mask&syscall.IN_MOVED_FROM != 0:
+				movedFrom[raw.Cookie] = ev
+				order = append(order, raw.Cookie)
+				continue
+			case raw.Mask&syscall.IN_MOVED_TO != 0:
+				if from, ok := movedFrom[raw.Cookie]; ok {
+					delete(movedFrom, raw.Cookie)
+					ev.OldPath = from.Path
+					ev.Op = Move
+					if filepath.Dir(from.Path) == filepath.Dir(ev.Path) {
+						ev.Op = Rename
+					}
+				} else {
+					ev.Op = Create
+				}
+			}
+			iw.send(ev)
+		}
+	}
+
+	for _, cookie := range order {
+		if ev, ok := movedFrom[cookie]; ok {
+			ev.Op = Remove
+			iw.send(ev)
+		}
+	}
+	return nil
+}
+
+// convert converts an inotify event to FileEvent, or reports false
+// if the event is not of a watched path.
+func (iw *inotifyWatcher) convert(wd int, mask uint32, name string) (FileEvent, bool) {
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+
+	if mask&syscall.IN_IGNORED != 0 {
+		if dir, ok := iw.wds[wd]; ok {
+			delete(iw.wds, wd)
+			delete(iw.dirs, dir)
+		}
+		return FileEvent{}, false
+	}
+
+	dir, ok := iw.wds[wd]
+	if !ok {
+		return FileEvent{}, false
+	}
+	path := dir
+	if name != "" {
+		path = filepath.Join(dir, name)
+	} else if _, ok := iw.dirs[filepath.Dir(dir)]; ok {
+		// Reported by the watch of the parent directory as well.
+		return FileEvent{}, false
+	}
+	if !iw.watched[path] && !iw.watched[filepath.Dir(path)] {
+		return FileEvent{}, false
+	}
+
+	ev := FileEvent{
+		Path:    path,
+		IsDir:   mask&syscall.IN_ISDIR != 0,
+		ModTime: time.Now(),
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		ev.ModTime = fi.ModTime()
+	}
+	switch {
+	case mask&syscall.IN_CREATE != 0:
+		ev.Op = Create
+	case mask&syscall.IN_MODIFY != 0:
+		ev.Op = Write
+	case mask&syscall.IN_ATTRIB != 0:
+		ev.Op = Chmod
+	case mask&syscall.IN_DELETE != 0:
+		ev.Op = Remove
+	case mask&(syscall.IN_MOVED_FROM|syscall.IN_MOVED_TO) != 0:
+		ev.Op = Rename
+	default:
+		return FileEvent{}, false
+	}
+	return ev, true
+}
+
+func (iw *inotifyWatcher) send(ev FileEvent) {
+	select {
+	case iw.events <- ev:
+	case <-iw.done:
+	}
+}
+
+func (iw *inotifyWatcher) sendError(err error) {
+	select {
+	case iw.errors <- err:
+	case <-iw.done:
+	}
+}
+
+func (iw *inotifyWatcher) Close() error {
+	iw.mu.Lock()
+	defer iw.mu.Unlock()
+	if iw.closed {
+		return nil
+	}
+	iw.closed = true
+	close(iw.done)
+	if !iw.started {
+		syscall.Close(iw.wake[1])
+		iw.release()
+		return nil
+	}
+	// Wake up Start, which releases the rest.
+	_, err := syscall.Write(iw.wake[1], []byte{0})
+	syscall.Close(iw.wake[1])
+	return err
+}
+
+// release closes file descriptors and the events channel.
+func (iw *inotifyWatcher) release() {
+	syscall.Close(iw.fd)
+	syscall.Close(iw.wake[0])
+	close(iw.events)
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package goemon
+
+import "time"
+
+// NewNativeWatcher initializes Watcher using the file notification API of the OS.
+// It is not implemented on this platform yet, so the poller is used instead.
+func NewNativeWatcher() (Watcher, error) {
+	return NewPollWatcher(200 * time.Millisecond), nil
+}
@@ -0,0 +1,197 @@
+package goemon
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/radovskyb/watcher"
+)
+
+// pollWatcher is Watcher which polls files by radovskyb/watcher.
+type pollWatcher struct {
+	w        *watcher.Watcher
+	interval time.Duration
+	events   chan FileEvent
+	errors   chan error
+	done     chan struct{}
+
+	mu      sync.Mutex
+	added   map[string]bool // absolute path to whether it is a directory
+	started bool
+	closed  bool
+}
+
+var pollOps = map[watcher.Op]Op{
+	watcher.Create: Create,
+	watcher.Write:  Write,
+	watcher.Remove: Remove,
+	watcher.Rename: Rename,
+	watcher.Move:   Move,
+	watcher.Chmod:  Chmod,
+}
+
+// NewPollWatcher initializes Watcher which polls files every interval.
+func NewPollWatcher(interval time.Duration) Watcher {
+	w := watcher.New()
+
+	// No cap on events per cycle, as the ones over it are lost for good.
+	w.SetMaxEvents(0)
+	w.IgnoreHiddenFiles(false)
+
+	w.FilterOps(
+		watcher.Remove,
+		watcher.Write,
+		watcher.Rename,
+		watcher.Move,
+		watcher.Chmod,
+		watcher.Create,
+	)
+	return &pollWatcher{
+		w:        w,
+		interval: interval,
+		events:   make(chan FileEvent),
+		errors:   make(chan error),
+		done:     make(chan struct{}),
+		added:    make(map[string]bool),
+	}
+}
+
+func (pw *pollWatcher) Add(path string) error {
+	if err := pw.w.Add(path); err != nil {
+		return err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return err
+	}
+	pw.mu.Lock()
+	pw.added[abs] = fi.IsDir()
+	pw.mu.Unlock()
+	return nil
+}
+
+func (pw *pollWatcher) Remove(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	pw.mu.Lock()
+	delete(pw.added, abs)
+	pw.mu.Unlock()
+	return pw.w.Remove(path)
+}
+
+func (pw *pollWatcher) WatchedFiles() []string {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	files := make([]string, 0, len(pw.added))
+	for k := range pw.added {
+		files = append(files, k)
+	}
+	return files
+}
+
+func (pw *pollWatcher) Events() <-chan FileEvent {
+	return pw.events
+}
+
+func (pw *pollWatcher) Errors() <-chan error {
+	return pw.errors
+}
+
+func (pw *pollWatcher) Start() error {
+	pw.mu.Lock()
+	if pw.closed {
+		pw.mu.Unlock()
+		return nil
+	}
+	pw.started = true
+	pw.mu.Unlock()
+
+	go pw.translate()
+	return pw.w.Start(pw.interval)
+}
+
+// translate converts events of radovskyb/watcher until it is closed.
+func (pw *pollWatcher) translate() {
+	defer close(pw.events)
+	for {
+		select {
+		case e := <-pw.w.Event:
+			ev := FileEvent{
+				Op:      pollOps[e.Op],
+				Path:    e.Path,
+				IsDir:   e.IsDir(),
+				ModTime: e.ModTime(),
+			}
+			if e.Op == watcher.Rename || e.Op == watcher.Move {
+				ev.OldPath = e.OldPath
+			}
+			select {
+			case pw.events <- ev:
+			case <-pw.done:
+			}
+		case err := <-pw.w.Error:
+			if err == watcher.ErrWatchedFileDeleted {
+				// radovskyb/watcher drops deleted directories before reporting
+				// their removal, so report it here.
+				for _, ev := range pw.removeDeleted() {
+					select {
+					case pw.events <- ev:
+					case <-pw.done:
+					}
+				}
+				continue
+			}
+			select {
+			case pw.errors <- err:
+			case <-pw.done:
+			}
+		case <-pw.w.Closed:
+			return
+		}
+	}
+}
+
+// removeDeleted removes added paths which no longer exist, and returns their Remove events.
+func (pw *pollWatcher) removeDeleted() []FileEvent {
+	pw.mu.Lock()
+	defer pw.mu.Unlock()
+	events := make([]FileEvent, 0)
+	for path, isDir := range pw.added {
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			continue
+		}
+		delete(pw.added, path)
+		events = append(events, FileEvent{Op: Remove, Path: path, IsDir: isDir, ModTime: time.Now()})
+	}
+	return events
+}
+
+func (pw *pollWatcher) Close() error {
+	pw.mu.Lock()
+	if pw.closed {
+		pw.mu.Unlock()
+		return nil
+	}
+	pw.closed = true
+	close(pw.done)
+	started := pw.started
+	pw.mu.Unlock()
+
+	if !started {
+		close(pw.events)
+		return nil
+	}
+	// Wait for Start to run, otherwise Close has no effect. The lock is not
+	// held, since translate may need it to receive the events blocking Start.
+	pw.w.Wait()
+	pw.w.Close()
+	return nil
+}
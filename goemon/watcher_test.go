@@ -0,0 +1,306 @@
+package goemon_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gcoka/goemon/goemon"
+)
+
+var backends = []struct {
+	name string
+	new  func() (goemon.Watcher, error)
+}{
+	{"native", goemon.NewNativeWatcher},
+	{"poll", func() (goemon.Watcher, error) { return goemon.NewPollWatcher(20 * time.Millisecond), nil }},
+}
+
+// expectEvent waits for an event of op on path, skipping other events.
+func expectEvent(t *testing.T, w goemon.Watcher, op goemon.Op, path string) goemon.FileEvent {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		select {
+		case ev := <-w.Events():
+			if ev.Op == op && ev.Path == path {
+				return ev
+			}
+		case err := <-w.Errors():
+			t.Fatalf("watcher error: %v", err)
+		case <-timeout:
+			t.Fatalf("no %v event of %v", op, path)
+		}
+	}
+}
+
+func TestWatcher_Events(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "goemon_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			tmpDir, _ = filepath.EvalSymlinks(tmpDir)
+
+			existing := filepath.Join(tmpDir, "existing.go")
+			ioutil.WriteFile(existing, []byte("package main"), 0644)
+
+			w, err := b.new()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Add(tmpDir); err != nil {
+				t.Fatal(err)
+			}
+			go w.Start()
+			defer w.Close()
+			// Let the poller take the first snapshot.
+			time.Sleep(100 * time.Millisecond)
+
+			created := filepath.Join(tmpDir, "created.go")
+			renamed := filepath.Join(tmpDir, "renamed.go")
+			subDir := filepath.Join(tmpDir, "sub")
+
+			steps := []struct {
+				name string
+				do   func() error
+				op   goemon.Op
+				path string
+			}{
+				{"create", func() error { return ioutil.WriteFile(created, []byte("package main"), 0644) }, goemon.Create, created},
+				{"write", func() error { return ioutil.WriteFile(existing, []byte("package main\n"), 0644) }, goemon.Write, existing},
+				{"chmod", func() error { return os.Chmod(existing, 0600) }, goemon.Chmod, existing},
+				{"rename", func() error { return os.Rename(created, renamed) }, goemon.Rename, renamed},
+				{"remove", func() error { return os.Remove(renamed) }, goemon.Remove, renamed},
+				{"create dir", func() error { return os.Mkdir(subDir, 0755) }, goemon.Create, subDir},
+			}
+			for _, s := range steps {
+				// Keep mod times apart for the poller.
+				time.Sleep(50 * time.Millisecond)
+				if err := s.do(); err != nil {
+					t.Fatal(err)
+				}
+				ev := expectEvent(t, w, s.op, s.path)
+				if s.op == goemon.Rename && ev.OldPath != created {
+					t.Errorf("%v: OldPath = %v, want %v", s.name, ev.OldPath, created)
+				}
+				if ev.IsDir != (s.path == subDir) {
+					t.Errorf("%v: IsDir = %v", s.name, ev.IsDir)
+				}
+			}
+		})
+	}
+}
+
+func TestWatcher_Many(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "goemon_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			tmpDir, _ = filepath.EvalSymlinks(tmpDir)
+
+			w, err := b.new()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Add(tmpDir); err != nil {
+				t.Fatal(err)
+			}
+			go w.Start()
+			defer w.Close()
+			time.Sleep(100 * time.Millisecond)
+
+			// Like a checkout, more changes than a poll cycle used to report.
+			want := make(map[string]bool)
+			for i := 0; i < 50; i++ {
+				f := filepath.Join(tmpDir, fmt.Sprintf("f%d.go", i))
+				if err := ioutil.WriteFile(f, nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+				want[f] = true
+			}
+			timeout := time.After(3 * time.Second)
+			for len(want) > 0 {
+				select {
+				case ev := <-w.Events():
+					if ev.Op == goemon.Create {
+						delete(want, ev.Path)
+					}
+				case err := <-w.Errors():
+					t.Fatalf("watcher error: %v", err)
+				case <-timeout:
+					t.Fatalf("no create events of %d files", len(want))
+				}
+			}
+		})
+	}
+}
+
+func TestWatcher_CloseAfterRemove(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "goemon_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			sub := filepath.Join(tmpDir, "sub")
+			os.Mkdir(sub, 0755)
+
+			w, err := b.new()
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Add(tmpDir)
+			w.Add(sub)
+			go w.Start()
+			time.Sleep(100 * time.Millisecond)
+
+			// Events are not received while the removal is reported and closed.
+			os.RemoveAll(sub)
+			time.Sleep(100 * time.Millisecond)
+			closed := make(chan struct{})
+			go func() {
+				w.Close()
+				close(closed)
+			}()
+			select {
+			case <-closed:
+			case <-time.After(3 * time.Second):
+				t.Fatal("Close() did not return")
+			}
+		})
+	}
+}
+
+func TestWatcher_File(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			tmpDir, err := ioutil.TempDir("", "goemon_test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(tmpDir)
+			tmpDir, _ = filepath.EvalSymlinks(tmpDir)
+
+			watched := filepath.Join(tmpDir, "watched.go")
+			sibling := filepath.Join(tmpDir, "sibling.go")
+			ioutil.WriteFile(watched, []byte{}, 0644)
+			ioutil.WriteFile(sibling, []byte{}, 0644)
+
+			w, err := b.new()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Add(watched); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.WatchedFiles(); len(got) != 1 || got[0] != watched {
+				t.Errorf("WatchedFiles() = %v, want [%v]", got, watched)
+			}
+			go w.Start()
+			defer w.Close()
+			time.Sleep(100 * time.Millisecond)
+
+			ioutil.WriteFile(sibling, []byte("sibling"), 0644)
+			ioutil.WriteFile(watched, []byte("watched"), 0644)
+
+			expectEvent(t, w, goemon.Write, watched)
+			timeout := time.After(100 * time.Millisecond)
+			for {
+				select {
+				case ev := <-w.Events():
+					// Truncating and writing may be reported separately.
+					if ev.Path != watched {
+						t.Errorf("unexpected event %v", ev)
+					}
+					continue
+				case <-timeout:
+				}
+				break
+			}
+		})
+	}
+}
+
+func TestWatcher_Close(t *testing.T) {
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			w, err := b.new()
+			if err != nil {
+				t.Fatal(err)
+			}
+			done := make(chan error)
+			go func() {
+				done <- w.Start()
+			}()
+			time.Sleep(50 * time.Millisecond)
+			w.Close()
+
+			select {
+			case <-done:
+			case <-time.After(3 * time.Second):
+				t.Fatal("Start() did not return after Close()")
+			}
+			if _, ok := <-w.Events(); ok {
+				t.Error("Events() is not closed after Close()")
+			}
+		})
+	}
+}
+
+func TestWatcher_AddMissing(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "goemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			w, err := b.new()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			if err := w.Add(filepath.Join(tmpDir, "missing")); !os.IsNotExist(err) {
+				t.Errorf("Add() error = %v, want not exist", err)
+			}
+		})
+	}
+}
+
+func TestParseOps(t *testing.T) {
+	tests := []struct {
+		names   []string
+		want    goemon.Op
+		wantErr bool
+	}{
+		{nil, goemon.AllOps, false},
+		{[]string{"create", "remove"}, goemon.Create | goemon.Remove, false},
+		{[]string{"create,Write|move"}, goemon.Create | goemon.Write | goemon.Move, false},
+		{[]string{"!chmod"}, goemon.AllOps &^ goemon.Chmod, false},
+		{[]string{"write", "!chmod"}, goemon.Write, false},
+		{[]string{"touch"}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.names, " "), func(t *testing.T) {
+			got, err := goemon.ParseOps(tt.names)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseOps() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseOps() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,225 @@
+package goemon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// watchIndex is the set of watched absolute paths, indexed by their parent
+// directories, so that the paths below a directory are found without
+// listing all of them.
+type watchIndex struct {
+	paths    map[string]bool
+	children map[string]map[string]bool
+}
+
+func newWatchIndex() *watchIndex {
+	return &watchIndex{
+		paths:    make(map[string]bool),
+		children: make(map[string]map[string]bool),
+	}
+}
+
+// add adds path, linking it to all its ancestors.
+func (x *watchIndex) add(path string) {
+	x.paths[path] = true
+	for {
+		parent := filepath.Dir(path)
+		if parent == path {
+			return
+		}
+		c, ok := x.children[parent]
+		if !ok {
+			c = make(map[string]bool)
+			x.children[parent] = c
+		}
+		if c[path] {
+			return
+		}
+		c[path] = true
+		path = parent
+	}
+}
+
+// remove removes path, and unlinks the ancestors left without watched paths below them.
+func (x *watchIndex) remove(path string) {
+	delete(x.paths, path)
+	for !x.paths[path] && len(x.children[path]) == 0 {
+		delete(x.children, path)
+		parent := filepath.Dir(path)
+		if parent == path {
+			return
+		}
+		delete(x.children[parent], path)
+		path = parent
+	}
+}
+
+// below returns root and the watched paths below it.
+func (x *watchIndex) below(root string) []string {
+	paths := make([]string, 0)
+	var walk func(path string)
+	walk = func(path string) {
+		if x.paths[path] {
+			paths = append(paths, path)
+		}
+		for c := range x.children[path] {
+			walk(c)
+		}
+	}
+	walk(root)
+	return paths
+}
+
+// watch adds path to the watcher and the index of the watched paths.
+func (g *Goemon) watch(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if err := g.watcher.Add(abs); err != nil {
+		return err
+	}
+	g.watched.add(abs)
+	return nil
+}
+
+// unwatch removes the absolute path from the watcher and the index of the watched paths.
+func (g *Goemon) unwatch(path string) {
+	g.watcher.Remove(path)
+	g.watched.remove(path)
+}
+
+// watchTree adds root, and the directories and the target files below it to the watcher.
+// Directories are watched even if they are not targets, so that new targets in them are found.
+// It returns the targets found, and the first error of the watcher adding them,
+// like when the watches of the OS are exhausted. Paths removed meanwhile are skipped.
+func (g *Goemon) watchTree(root string) (map[string]os.FileInfo, error) {
+	targets := make(map[string]os.FileInfo)
+	dirs := make(map[string]bool)
+	var failed error
+	add := func(path string) {
+		if err := g.watch(path); err != nil && !os.IsNotExist(err) && failed == nil {
+			failed = err
+		}
+	}
+	g.filter.Walk(root, func(path string, fi os.FileInfo) {
+		if fi.IsDir() {
+			add(path)
+			dirs[path] = true
+		}
+		if g.filter.IsTarget(path, fi.IsDir()) {
+			if !fi.IsDir() {
+				// The directory may be ignored, but contain targets.
+				if dir := filepath.Dir(path); !dirs[dir] {
+					add(dir)
+					dirs[dir] = true
+				}
+				add(path)
+			}
+			targets[path] = fi
+		}
+	})
+	return targets, failed
+}
+
+// unwatchTree removes root and all the paths below it from the watcher.
+// It returns the removed paths.
+func (g *Goemon) unwatchTree(root string) []string {
+	removed := g.watched.below(root)
+	for _, f := range removed {
+		g.unwatch(f)
+	}
+	return removed
+}
+
+// syncWatches keeps the watch set in sync with created and removed paths,
+// and returns the events to handle for ev. They are ev itself unless it
+// creates an already watched path, removes of the watched paths below a removed
+// directory, which may not be reported by the watcher, and creates of the target
+// files found in a created directory, which may be created before it was watched.
+func (g *Goemon) syncWatches(ev FileEvent) []FileEvent {
+	events := make([]FileEvent, 0, 1)
+	if ev.Op&(Remove|Rename|Move) != 0 {
+		old := ev.Path
+		if ev.OldPath != "" {
+			old = ev.OldPath
+		}
+		for _, f := range g.unwatchTree(old) {
+			if f != old {
+				events = append(events, FileEvent{Op: Remove, Path: f, ModTime: ev.ModTime})
+			}
+		}
+	}
+	if g.filter.IsIgnoreFile(ev.Path) || (ev.OldPath != "" && g.filter.IsIgnoreFile(ev.OldPath)) {
+		g.reloadIgnoreFile(ev)
+	}
+	if ev.Op&(Create|Rename|Move) == 0 {
+		return append(events, ev)
+	}
+	if g.filter.IsIgnored(ev.Path, ev.IsDir) && (!ev.IsDir || g.filter.skipDir(ev.Path)) {
+		return append(events, ev)
+	}
+
+	if ev.Op == Create && g.watched.paths[ev.Path] {
+		// Already found in a created directory.
+		return events
+	}
+	events = append(events, ev)
+	if !ev.IsDir {
+		if g.filter.IsTarget(ev.Path, false) {
+			if err := g.watch(ev.Path); err != nil && !os.IsNotExist(err) {
+				fmt.Printf("[goemon] failed to watch: %v\n", err)
+			}
+		}
+		return events
+	}
+
+	watched := make(map[string]bool)
+	for _, f := range g.watched.below(ev.Path) {
+		watched[f] = true
+	}
+	targets, err := g.watchTree(ev.Path)
+	if err != nil {
+		fmt.Printf("[goemon] failed to watch: %v\n", err)
+	}
+	for f, fi := range targets {
+		if f == ev.Path || watched[f] {
+			continue
+		}
+		events = append(events, FileEvent{Op: Create, Path: f, IsDir: fi.IsDir(), ModTime: fi.ModTime()})
+	}
+	return events
+}
+
+// reloadIgnoreFile reloads the ignore file changed by ev, and updates the watch set by it.
+func (g *Goemon) reloadIgnoreFile(ev FileEvent) {
+	for _, f := range []string{ev.OldPath, ev.Path} {
+		if f != "" && g.filter.IsIgnoreFile(f) {
+			if err := g.filter.Reload(f); err != nil {
+				fmt.Printf("[goemon] failed to reload %v: %v\n", f, err)
+			}
+		}
+	}
+	for f := range g.watched.paths {
+		fi, err := os.Stat(f)
+		if err == nil && g.filter.IsIgnored(f, fi.IsDir()) {
+			g.unwatch(f)
+		}
+	}
+	if _, err := g.watchTree(g.root); err != nil {
+		fmt.Printf("[goemon] failed to watch: %v\n", err)
+	}
+}
+
+// rescan watches the tree again after events were lost, and queues a change
+// of the root, which restarts all processes as the changes are unknown.
+func (g *Goemon) rescan() {
+	fmt.Printf("[goemon] %v, rescanning %v\n", ErrOverflow, g.root)
+	if _, err := g.watchTree(g.root); err != nil {
+		fmt.Printf("[goemon] failed to watch: %v\n", err)
+	}
+	g.debouncer.Add(FileEvent{Op: Write, Path: g.root, IsDir: true, ModTime: time.Now()})
+}